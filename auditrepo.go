@@ -0,0 +1,368 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AuditCreate = "Create"
+	AuditSave   = "Save"
+	AuditDelete = "Delete"
+	AuditEvent  = "Audit"
+)
+
+var (
+	ErrAuditHistoryUnsupported = errors.New("audit sink does not support history queries")
+	// ErrAuditRollbackFailed means the audit record could not be written and
+	// undoing the change failed too, so the change was kept without a record.
+	ErrAuditRollbackFailed = errors.New("audit record failed and the change could not be undone")
+)
+
+type AuditRecord struct {
+	BaseEntity[string]
+	EntityId  string          `json:"entityId"`
+	TenantId  string          `json:"tenantId,omitempty"`
+	Operation string          `json:"operation"`
+	Actor     string          `json:"actor"`
+	Timestamp time.Time       `json:"timestamp"`
+	Diff      json.RawMessage `json:"diff,omitempty"`
+}
+
+type AuditSink interface {
+	Record(ctx context.Context, record *AuditRecord) error
+	History(ctx context.Context, entityId string) ([]*AuditRecord, error)
+}
+
+type AuditedRepository[T Entity[S], S comparable] struct {
+	Repository[T, S]
+	sink AuditSink
+	seq  uint64
+	mu   sync.Mutex
+}
+
+// Create, Save and Delete record the change after making it. If the sink
+// fails the change is undone and the sink's error returned, so an error means
+// the entity is as it was; only an error wrapping ErrAuditRollbackFailed means
+// the change was kept without an audit record.
+func (ar *AuditedRepository[T, S]) Create(ctx context.Context, e T) error {
+	if err := ar.Repository.Create(ctx, e); err != nil {
+		return err
+	}
+	return ar.record(ctx, AuditCreate, e.GetID(), e.GetVersion(), nil, e, func() error {
+		return ar.Repository.Delete(ctx, e)
+	})
+}
+
+func (ar *AuditedRepository[T, S]) Save(ctx context.Context, e T) error {
+	old, err := ar.Repository.Get(ctx, e.GetID())
+	if err != nil {
+		return err
+	}
+	if err := ar.Repository.Save(ctx, e); err != nil {
+		return err
+	}
+	return ar.record(ctx, AuditSave, e.GetID(), e.GetVersion(), old, e, func() error {
+		return ar.Repository.Save(ctx, old)
+	})
+}
+
+func (ar *AuditedRepository[T, S]) Delete(ctx context.Context, e T) error {
+	old, err := ar.Repository.Get(ctx, e.GetID())
+	if err != nil {
+		return err
+	}
+	if err := ar.Repository.Delete(ctx, e); err != nil {
+		return err
+	}
+	return ar.record(ctx, AuditDelete, e.GetID(), e.GetVersion(), old, nil, func() error {
+		return ar.Repository.Create(ctx, old)
+	})
+}
+
+func (ar *AuditedRepository[T, S]) History(ctx context.Context, ID S) ([]*AuditRecord, error) {
+	return ar.sink.History(ctx, fmt.Sprint(ID))
+}
+
+// record writes the audit record for a change, calling undo to reverse the
+// change if it cannot.
+func (ar *AuditedRepository[T, S]) record(ctx context.Context, op string, id S, version int, old, new any, undo func() error) error {
+	err := ar.write(ctx, op, id, version, old, new)
+	if err == nil {
+		return nil
+	}
+
+	if undoErr := undo(); undoErr != nil {
+		return fmt.Errorf("%w: %s %v: %w", ErrAuditRollbackFailed, op, id, errors.Join(err, undoErr))
+	}
+	return fmt.Errorf("auditing %s %v: %w", op, id, err)
+}
+
+func (ar *AuditedRepository[T, S]) write(ctx context.Context, op string, id S, version int, old, new any) error {
+	diff, err := jsonDiff(old, new)
+	if err != nil {
+		return err
+	}
+
+	ts := time.Now()
+
+	ar.mu.Lock()
+	ar.seq++
+	seq := ar.seq
+	ar.mu.Unlock()
+
+	rec := &AuditRecord{
+		BaseEntity: BaseEntity[string]{
+			ID:             fmt.Sprintf("%s-%d-%d", fmt.Sprint(id), ts.UnixNano(), seq),
+			CreationDate:   ts,
+			LastUpdateDate: ts,
+			Version:        version,
+		},
+		EntityId:  fmt.Sprint(id),
+		TenantId:  TenantFromContext(ctx),
+		Operation: op,
+		Actor:     actorFromContext(ctx),
+		Timestamp: ts,
+		Diff:      diff,
+	}
+
+	return ar.sink.Record(ctx, rec)
+}
+
+func (r *AuditRecord) inScope(ctx context.Context, entityId string) bool {
+	return r.EntityId == entityId && r.TenantId == TenantFromContext(ctx)
+}
+
+func actorFromContext(ctx context.Context) string {
+	userId, ok := UserFromContext(ctx)
+	if !ok {
+		return "Anonymous"
+	}
+	return strconv.Itoa(userId)
+}
+
+// actorContext returns ctx with the user an event's actor names, the
+// reverse of actorFromContext. Anonymous actors leave ctx without a user.
+func actorContext(ctx context.Context, actor string) context.Context {
+	userId, err := strconv.Atoi(actor)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, "user", userId)
+}
+
+// jsonDiff compares the top level JSON fields of old and new and returns an
+// object of the form {"field": {"old": ..., "new": ...}} for every field that
+// changed. A nil old or new value is treated as an empty object.
+func jsonDiff(old, new any) (json.RawMessage, error) {
+	o, err := toJSONMap(old)
+	if err != nil {
+		return nil, err
+	}
+	n, err := toJSONMap(new)
+	if err != nil {
+		return nil, err
+	}
+
+	type change struct {
+		Old any `json:"old,omitempty"`
+		New any `json:"new,omitempty"`
+	}
+
+	diff := map[string]change{}
+	for k, ov := range o {
+		nv, ok := n[k]
+		if !ok || !reflect.DeepEqual(ov, nv) {
+			diff[k] = change{Old: ov, New: nv}
+		}
+	}
+	for k, nv := range n {
+		if _, ok := o[k]; !ok {
+			diff[k] = change{New: nv}
+		}
+	}
+
+	return json.Marshal(diff)
+}
+
+func toJSONMap(v any) (map[string]any, error) {
+	m := map[string]any{}
+	if v == nil {
+		return m, nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return m, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type InMemoryAuditSink struct {
+	records []*AuditRecord
+	mu      sync.RWMutex
+}
+
+func (s *InMemoryAuditSink) Record(ctx context.Context, record *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *InMemoryAuditSink) History(ctx context.Context, entityId string) ([]*AuditRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history := []*AuditRecord{}
+	for _, r := range s.records {
+		if r.inScope(ctx, entityId) {
+			history = append(history, r)
+		}
+	}
+	return history, nil
+}
+
+func NewInMemoryAuditSink() *InMemoryAuditSink {
+	return &InMemoryAuditSink{}
+}
+
+type RepositoryAuditSink struct {
+	repo Repository[*AuditRecord, string]
+}
+
+func (s *RepositoryAuditSink) Record(ctx context.Context, record *AuditRecord) error {
+	return s.repo.Create(ctx, record)
+}
+
+func (s *RepositoryAuditSink) History(ctx context.Context, entityId string) ([]*AuditRecord, error) {
+	all, err := s.repo.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	history := []*AuditRecord{}
+	for _, r := range all {
+		if r != nil && r.inScope(ctx, entityId) {
+			history = append(history, r)
+		}
+	}
+	sortAuditRecords(history)
+	return history, nil
+}
+
+func NewRepositoryAuditSink(repo Repository[*AuditRecord, string]) *RepositoryAuditSink {
+	return &RepositoryAuditSink{repo: repo}
+}
+
+// FileAuditSink appends records to a file as JSON lines.
+type FileAuditSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *FileAuditSink) Record(ctx context.Context, record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *FileAuditSink) History(ctx context.Context, entityId string) ([]*AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := []*AuditRecord{}
+
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		if r.inScope(ctx, entityId) {
+			history = append(history, &r)
+		}
+	}
+	return history, scanner.Err()
+}
+
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{path: path}
+}
+
+// TransportAuditSink publishes every record as an event. History is not
+// available from the transport, consumers build it from the event stream.
+type TransportAuditSink struct {
+	transport Transport
+	prefix    string
+}
+
+func (s *TransportAuditSink) Record(ctx context.Context, record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.transport.PostEvent(Event{
+		EventId:      NewEventId(),
+		EventType:    s.prefix + AuditEvent,
+		EventTime:    record.Timestamp,
+		EventVersion: Version,
+		EventData:    string(b),
+	})
+}
+
+func (s *TransportAuditSink) History(ctx context.Context, entityId string) ([]*AuditRecord, error) {
+	return nil, ErrAuditHistoryUnsupported
+}
+
+func NewTransportAuditSink(transport Transport, prefix string) *TransportAuditSink {
+	return &TransportAuditSink{transport: transport, prefix: prefix}
+}
+
+func sortAuditRecords(records []*AuditRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+}
+
+func NewAuditedRepository[T Entity[S], S comparable](repo Repository[T, S], sink AuditSink) *AuditedRepository[T, S] {
+	return &AuditedRepository[T, S]{
+		Repository: repo,
+		sink:       sink,
+	}
+}
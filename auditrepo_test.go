@@ -0,0 +1,159 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type AuditedObject struct {
+	common.BaseEntity[string]
+	Notes string `json:"notes"`
+}
+
+func TestAuditedRepository(t *testing.T) {
+	sink := common.NewInMemoryAuditSink()
+	repo := common.NewAuditedRepository(common.NewInMemoryRepository[*AuditedObject](), sink)
+
+	ctx := context.WithValue(context.Background(), "user", 42)
+
+	err := repo.Create(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1", Version: 1}, Notes: "first"})
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	err = repo.Save(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1", Version: 2}, Notes: "second"})
+	if err != nil {
+		t.Fatalf("Error saving entity: %v", err)
+	}
+
+	err = repo.Delete(context.Background(), &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1", Version: 2}})
+	if err != nil {
+		t.Fatalf("Error deleting entity: %v", err)
+	}
+
+	history, err := repo.History(ctx, "1")
+	if err != nil {
+		t.Fatalf("Error getting history: %v", err)
+	}
+
+	if len(history) != 3 {
+		t.Fatalf("History length is not correct: %d", len(history))
+	}
+
+	ops := []string{common.AuditCreate, common.AuditSave, common.AuditDelete}
+	for i, op := range ops {
+		if history[i].Operation != op {
+			t.Errorf("Operation %d is not correct: %s", i, history[i].Operation)
+		}
+	}
+
+	if history[0].Actor != "42" {
+		t.Errorf("Actor is not correct: %s", history[0].Actor)
+	}
+
+	if history[2].Actor != "Anonymous" {
+		t.Errorf("Actor is not correct: %s", history[2].Actor)
+	}
+
+	if history[1].Version != 2 {
+		t.Errorf("Version is not correct: %d", history[1].Version)
+	}
+
+	var diff map[string]map[string]any
+	if err := json.Unmarshal(history[1].Diff, &diff); err != nil {
+		t.Fatalf("Error decoding diff: %v", err)
+	}
+
+	if diff["notes"]["old"] != "first" || diff["notes"]["new"] != "second" {
+		t.Errorf("Diff is not correct: %s", history[1].Diff)
+	}
+
+	if _, ok := diff["id"]; ok {
+		t.Errorf("Unchanged field in diff: %s", history[1].Diff)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	sink := common.NewFileAuditSink(filepath.Join(t.TempDir(), "audit.log"))
+	repo := common.NewAuditedRepository(common.NewInMemoryRepository[*AuditedObject](), sink)
+
+	ctx := context.Background()
+
+	repo.Create(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1"}})
+	repo.Create(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "2"}})
+
+	history, err := repo.History(ctx, "2")
+	if err != nil {
+		t.Fatalf("Error getting history: %v", err)
+	}
+
+	if len(history) != 1 || history[0].EntityId != "2" {
+		t.Errorf("History is not correct: %+v", history)
+	}
+}
+
+func TestRepositoryAuditSink(t *testing.T) {
+	sink := common.NewRepositoryAuditSink(common.NewInMemoryRepository[*common.AuditRecord]())
+	repo := common.NewAuditedRepository(common.NewInMemoryRepository[*AuditedObject](), sink)
+
+	ctx := context.Background()
+
+	repo.Create(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1"}})
+	repo.Save(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1"}, Notes: "changed"})
+
+	history, err := repo.History(ctx, "1")
+	if err != nil {
+		t.Fatalf("Error getting history: %v", err)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("History length is not correct: %d", len(history))
+	}
+
+	if history[0].Operation != common.AuditCreate {
+		t.Errorf("History is not ordered: %s", history[0].Operation)
+	}
+}
+
+type failingAuditSink struct {
+	common.InMemoryAuditSink
+}
+
+func (s *failingAuditSink) Record(ctx context.Context, record *common.AuditRecord) error {
+	return errors.New("sink unavailable")
+}
+
+func TestAuditedRepositoryUndoesUnauditedChanges(t *testing.T) {
+	inner := common.NewInMemoryRepository[*AuditedObject]()
+	repo := common.NewAuditedRepository(inner, &failingAuditSink{})
+
+	ctx := context.Background()
+
+	if err := repo.Create(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "1"}}); err == nil {
+		t.Fatal("Create should fail when the sink fails")
+	}
+	if ok, _ := inner.Exists(ctx, "1"); ok {
+		t.Error("Create was not undone")
+	}
+
+	inner.Create(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "2"}, Notes: "kept"})
+
+	if err := repo.Save(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "2"}, Notes: "changed"}); err == nil {
+		t.Fatal("Save should fail when the sink fails")
+	}
+	if e, _ := inner.Get(ctx, "2"); e.Notes != "kept" {
+		t.Errorf("Save was not undone: %+v", e)
+	}
+
+	if err := repo.Delete(ctx, &AuditedObject{BaseEntity: common.BaseEntity[string]{ID: "2"}}); err == nil || errors.Is(err, common.ErrAuditRollbackFailed) {
+		t.Fatalf("Delete should fail and be undone: %v", err)
+	}
+	if e, _ := inner.Get(ctx, "2"); e == nil || e.Notes != "kept" {
+		t.Errorf("Delete was not undone: %+v", e)
+	}
+}
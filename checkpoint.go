@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// CheckpointStore keeps the id of the last event a named consumer has
+// handled, so it can resume from there after a restart.
+type CheckpointStore interface {
+	Load(ctx context.Context, name string) (string, error)
+	Save(ctx context.Context, name string, eventId string) error
+}
+
+type InMemoryCheckpointStore struct {
+	checkpoints map[string]string
+	mu          sync.RWMutex
+}
+
+func (s *InMemoryCheckpointStore) Load(ctx context.Context, name string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkpoints[name], nil
+}
+
+func (s *InMemoryCheckpointStore) Save(ctx context.Context, name string, eventId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[name] = eventId
+	return nil
+}
+
+func NewInMemoryCheckpointStore() *InMemoryCheckpointStore {
+	return &InMemoryCheckpointStore{
+		checkpoints: make(map[string]string),
+	}
+}
+
+type FileCheckpointStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (s *FileCheckpointStore) Load(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+func (s *FileCheckpointStore) Save(ctx context.Context, name string, eventId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path(name) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(eventId), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(name))
+}
+
+func (s *FileCheckpointStore) path(name string) string {
+	return filepath.Join(s.dir, url.PathEscape(name)+".checkpoint")
+}
+
+func NewFileCheckpointStore(dir string) *FileCheckpointStore {
+	return &FileCheckpointStore{dir: dir}
+}
+
+type MemcacheCheckpointStore struct {
+	client MemcacheClient
+	prefix string
+}
+
+func (s *MemcacheCheckpointStore) Load(ctx context.Context, name string) (string, error) {
+	item, err := s.client.Get(s.prefix + "checkpoint:" + name)
+	if errors.Is(err, memcache.ErrCacheMiss) || (err == nil && item == nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(item.Value), nil
+}
+
+func (s *MemcacheCheckpointStore) Save(ctx context.Context, name string, eventId string) error {
+	return s.client.Set(&memcache.Item{
+		Key:   s.prefix + "checkpoint:" + name,
+		Value: []byte(eventId),
+	})
+}
+
+func NewMemcacheCheckpointStore(host string, prefix string, mc MemcacheClient) *MemcacheCheckpointStore {
+	if mc == nil {
+		mc = memcache.New(host)
+	}
+	return &MemcacheCheckpointStore{
+		client: mc,
+		prefix: prefix,
+	}
+}
@@ -0,0 +1,134 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := common.NewFileCheckpointStore(dir)
+
+	id, err := store.Load(ctx, "runner")
+	if err != nil || id != "" {
+		t.Errorf("Missing checkpoint should be empty: %s %v", id, err)
+	}
+
+	store.Save(ctx, "runner", "42")
+
+	id, _ = common.NewFileCheckpointStore(dir).Load(ctx, "runner")
+	if id != "42" {
+		t.Errorf("Checkpoint is not correct: %s", id)
+	}
+}
+
+func TestMemcacheCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	store := common.NewMemcacheCheckpointStore("", "test", &MockMemcacheClient{store: make(map[string][]byte)})
+
+	store.Save(ctx, "runner", "42")
+
+	id, err := store.Load(ctx, "runner")
+	if err != nil || id != "42" {
+		t.Errorf("Checkpoint is not correct: %s %v", id, err)
+	}
+}
+
+func sseEvent(eventType string, id string) string {
+	return sseStreamEvent(eventType, id, id)
+}
+
+// sseStreamEvent returns an event whose stream id differs from its event id.
+func sseStreamEvent(eventType string, id string, streamId string) string {
+	data, _ := json.Marshal(common.BaseEntity[string]{ID: id})
+	ev, _ := json.Marshal(common.Event{EventId: id, EventType: eventType, EventData: string(data)})
+	return fmt.Sprintf("event: %s\ndata: %s\nid: %s\n\n", eventType, ev, streamId)
+}
+
+func TestEventRunnerCheckpoint(t *testing.T) {
+	var mu sync.Mutex
+	lastEventIds := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastEventIds = append(lastEventIds, r.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(sseStreamEvent("testCreated", "A", "41")))
+		w.Write([]byte(sseStreamEvent("testCreated", "B", "42")))
+	}))
+	defer server.Close()
+
+	store := common.NewFileCheckpointStore(t.TempDir())
+	store.Save(context.Background(), "runner", "previous")
+
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, common.NewHttpTransport("", server.URL, 1), "test")
+	es.SetCheckpointStore(store, "runner", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	es.StartEventRunner(ctx)
+
+	for {
+		// The stream's id is checkpointed, as that is what it resumes from.
+		id, _ := store.Load(context.Background(), "runner")
+		if id == "42" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Checkpoint was not saved: %s", id)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if lastEventIds[0] != "previous" {
+		t.Errorf("Runner did not resume from the checkpoint: %v", lastEventIds)
+	}
+}
+
+func TestEventRunnerCheckpointWithoutStreamIds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, id := range []string{"A", "B"} {
+			data, _ := json.Marshal(common.BaseEntity[string]{ID: id})
+			ev, _ := json.Marshal(common.Event{EventId: id, EventType: "testCreated", EventData: string(data)})
+			fmt.Fprintf(w, "event: testCreated\ndata: %s\n\n", ev)
+		}
+	}))
+	defer server.Close()
+
+	store := common.NewFileCheckpointStore(t.TempDir())
+	store.Save(context.Background(), "runner", "previous")
+
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, common.NewHttpTransport("", server.URL, 1), "test")
+	es.SetCheckpointStore(store, "runner", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	es.StartEventRunner(ctx)
+
+	// Without stream ids the event id is checkpointed, not the stale cursor.
+	waitFor(t, "event id to be checkpointed", func() bool {
+		id, _ := store.Load(context.Background(), "runner")
+		return id == "B"
+	})
+}
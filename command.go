@@ -0,0 +1,389 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CommandEventPrefix starts the event type of commands sent to another
+	// service, followed by the command name.
+	CommandEventPrefix = "command:"
+	// CommandReplyEvent is the event type of the reply to a remote command.
+	// It has the command's correlation id.
+	CommandReplyEvent = "commandReply"
+)
+
+var (
+	ErrNoCommandHandler     = errors.New("no handler for command")
+	ErrCommandHandlerExists = errors.New("command already has a handler")
+	ErrInvalidCommand       = errors.New("invalid command")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrCommandTimeout       = errors.New("timed out waiting for command reply")
+)
+
+// CommandFunc handles a command. Commands are passed as any so middleware
+// can handle every type.
+type CommandFunc func(ctx context.Context, cmd any) error
+
+type CommandMiddleware func(CommandFunc) CommandFunc
+
+// RemoteCommandError is a failure reported by the service that handled a
+// remote command.
+type RemoteCommandError struct {
+	Command string
+	Message string
+}
+
+func (e *RemoteCommandError) Error() string {
+	return fmt.Sprintf("command %s failed: %s", e.Command, e.Message)
+}
+
+type commandReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+type commandEntry struct {
+	handle CommandFunc
+	decode func(data []byte) (any, error)
+}
+
+// CommandName returns the name a command is registered and sent under. It is
+// the result of the command's CommandName method if it has one, or its type
+// name.
+func CommandName(cmd any) string {
+	if named, ok := cmd.(interface{ CommandName() string }); ok {
+		return named.CommandName()
+	}
+	t := reflect.TypeOf(cmd)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return ""
+	}
+	return t.Name()
+}
+
+// commandTypeName returns the CommandName of commands of type C. Pointer
+// types are named through a new value, since the zero pointer is nil and
+// CommandName may have a value receiver.
+func commandTypeName[C any]() string {
+	t := reflect.TypeFor[C]()
+	if t.Kind() == reflect.Pointer {
+		return CommandName(reflect.New(t.Elem()).Interface())
+	}
+	var zero C
+	return CommandName(zero)
+}
+
+// CommandBus dispatches each command to the one handler registered for its
+// type. Commands with no local handler can be sent through a transport to
+// the service that has one, which replies with the outcome.
+type CommandBus struct {
+	mu           sync.RWMutex
+	handlers     map[string]commandEntry
+	middleware   []CommandMiddleware
+	transport    Transport
+	remote       map[string]bool
+	replies      *awaiters
+	replyTimeout time.Duration
+	verifier     *EventVerifier
+}
+
+// Handle registers handler for commands of type C. A command can only have
+// one handler.
+func Handle[C any](bus *CommandBus, handler func(ctx context.Context, cmd C) error) error {
+	name := commandTypeName[C]()
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	if _, ok := bus.handlers[name]; ok {
+		return fmt.Errorf("%w: %s", ErrCommandHandlerExists, name)
+	}
+
+	bus.handlers[name] = commandEntry{
+		handle: func(ctx context.Context, cmd any) error {
+			c, ok := cmd.(C)
+			if !ok {
+				return fmt.Errorf("%w: %s is not a %s", ErrInvalidCommand, reflect.TypeOf(cmd), name)
+			}
+			return handler(ctx, c)
+		},
+		decode: func(data []byte) (any, error) {
+			var c C
+			err := JSONCodec{}.Unmarshal(data, &c)
+			return c, err
+		},
+	}
+	return nil
+}
+
+// Use adds middleware that runs around every local handler, including for
+// commands received from other services.
+func (bus *CommandBus) Use(mw ...CommandMiddleware) {
+	bus.middleware = append(bus.middleware, mw...)
+}
+
+// SetTransport sets the transport remote commands and replies are posted to.
+func (bus *CommandBus) SetTransport(transport Transport) {
+	bus.transport = transport
+}
+
+// Remote sends the named commands to other services instead of handling
+// them locally.
+func (bus *CommandBus) Remote(names ...string) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for _, name := range names {
+		bus.remote[name] = true
+	}
+}
+
+// SetReplyTimeout sets how long Dispatch waits for the reply to a remote
+// command. The default is 5 seconds.
+func (bus *CommandBus) SetReplyTimeout(timeout time.Duration) {
+	bus.replyTimeout = timeout
+}
+
+// SetVerifier sets the verifier that remote commands must pass before they
+// run as the actor that sent them. The verifier must have trusted keys;
+// without it, or when the signature does not verify, remote commands run
+// anonymously.
+func (bus *CommandBus) SetVerifier(verifier *EventVerifier) {
+	bus.verifier = verifier
+}
+
+// Register subscribes the bus to sub, so it handles commands sent by other
+// services and receives the replies to its own.
+func (bus *CommandBus) Register(sub EventSubscriber) {
+	sub.Subscribe(CommandEventPrefix+"*", bus.handleRemote)
+	sub.Subscribe(CommandReplyEvent, bus.handleReply)
+}
+
+// Dispatch hands cmd to its handler, or sends it to another service and
+// waits for the reply.
+func (bus *CommandBus) Dispatch(ctx context.Context, cmd any) error {
+	name := CommandName(cmd)
+
+	bus.mu.RLock()
+	remote := bus.remote[name]
+	entry, ok := bus.handlers[name]
+	bus.mu.RUnlock()
+
+	if remote {
+		return bus.sendRemote(ctx, name, cmd)
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoCommandHandler, name)
+	}
+
+	handler := entry.handle
+	for i := range bus.middleware {
+		handler = bus.middleware[len(bus.middleware)-1-i](handler)
+	}
+	return handler(ctx, cmd)
+}
+
+func (bus *CommandBus) sendRemote(ctx context.Context, name string, cmd any) error {
+	if bus.transport == nil {
+		return fmt.Errorf("%w: %s has no transport", ErrNoCommandHandler, name)
+	}
+
+	data, err := JSONCodec{}.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	id := NewEventId()
+	event := Event{
+		EventId:       id,
+		EventType:     CommandEventPrefix + name,
+		EventData:     string(data),
+		EventVersion:  Version,
+		EventTime:     time.Now(),
+		TenantId:      TenantFromContext(ctx),
+		CorrelationId: id,
+		CausationId:   CausationIdFromContext(ctx),
+		Actor:         actorFromContext(ctx),
+		Metadata:      EventMetadataFromContext(ctx),
+	}
+
+	reply := bus.replies.add(id)
+	defer bus.replies.remove(id)
+
+	if err := bus.transport.PostEvent(event); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(bus.replyTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-reply:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w: %s", ErrCommandTimeout, name)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleRemote handles a command sent by another service and posts the
+// reply. The command runs as the actor that sent it when its signature is
+// verified, and anonymously otherwise. It runs off the event runner, so a
+// handler can wait on events and replies the runner has yet to deliver.
+// Commands this service has no handler for are left to others.
+func (bus *CommandBus) handleRemote(ctx context.Context, event Event) error {
+	name := strings.TrimPrefix(event.EventType, CommandEventPrefix)
+
+	bus.mu.RLock()
+	entry, ok := bus.handlers[name]
+	remote := bus.remote[name]
+	bus.mu.RUnlock()
+
+	if !ok || remote {
+		return nil
+	}
+	if bus.transport == nil {
+		return fmt.Errorf("cannot reply to command %s: no transport", name)
+	}
+
+	// The command outlives the event's handling, so it keeps the context's
+	// values but not its cancellation or handler progress.
+	ctx = context.WithValue(context.WithoutCancel(ctx), "handlerProgress", (*handlerProgress)(nil))
+	if bus.trusted(event) {
+		ctx = actorContext(ctx, event.Actor)
+	}
+
+	go func() {
+		if err := bus.runRemote(ctx, name, entry, event); err != nil {
+			slog.Error("Error replying to command", "command", name, "eventId", event.EventId, "error", err)
+		}
+	}()
+	return nil
+}
+
+// trusted reports whether event carries a signature from one of the
+// verifier's trusted keys, so its actor can be believed.
+func (bus *CommandBus) trusted(event Event) bool {
+	if bus.verifier == nil || bus.verifier.Keys == nil {
+		return false
+	}
+	if err := bus.verifier.Verify(event); err != nil {
+		slog.Warn("Running remote command anonymously", "eventId", event.EventId, "error", err)
+		return false
+	}
+	return true
+}
+
+func (bus *CommandBus) runRemote(ctx context.Context, name string, entry commandEntry, event Event) error {
+	var reply commandReply
+	cmd, err := entry.decode([]byte(event.EventData))
+	if err != nil {
+		reply.Error = (&EventDecodeError{Data: event.EventData, Err: err}).Error()
+	} else if err := bus.Dispatch(ctx, cmd); err != nil {
+		reply.Error = err.Error()
+	}
+
+	data, err := JSONCodec{}.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	return bus.transport.PostEvent(Event{
+		EventId:       NewEventId(),
+		EventType:     CommandReplyEvent,
+		EventData:     string(data),
+		EventVersion:  Version,
+		EventTime:     time.Now(),
+		TenantId:      event.TenantId,
+		CorrelationId: event.CorrelationId,
+		CausationId:   event.EventId,
+		Metadata:      map[string]string{"command": name},
+	})
+}
+
+func (bus *CommandBus) handleReply(ctx context.Context, event Event) error {
+	var reply commandReply
+	if err := (JSONCodec{}).Unmarshal([]byte(event.EventData), &reply); err != nil {
+		return &EventDecodeError{Data: event.EventData, Err: err}
+	}
+
+	var err error
+	if reply.Error != "" {
+		err = &RemoteCommandError{Command: event.Metadata["command"], Message: reply.Error}
+	}
+	bus.replies.done(event.CorrelationId, err)
+	return nil
+}
+
+// CommandValidation rejects commands whose Validate method returns an error.
+func CommandValidation(next CommandFunc) CommandFunc {
+	return func(ctx context.Context, cmd any) error {
+		if v, ok := cmd.(interface{ Validate() error }); ok {
+			if err := v.Validate(); err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidCommand, err)
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// CommandAuthorization rejects commands that authorize returns false for.
+func CommandAuthorization(authorize func(ctx context.Context, cmd any) bool) CommandMiddleware {
+	return func(next CommandFunc) CommandFunc {
+		return func(ctx context.Context, cmd any) error {
+			if !authorize(ctx, cmd) {
+				return fmt.Errorf("%w: %s", ErrUnauthorized, CommandName(cmd))
+			}
+			return next(ctx, cmd)
+		}
+	}
+}
+
+// CommandIdempotency skips commands whose idempotency key has already been
+// handled successfully. The key comes from the command's IdempotencyKey
+// method; commands without one always run.
+func CommandIdempotency(store DedupStore) CommandMiddleware {
+	return func(next CommandFunc) CommandFunc {
+		return func(ctx context.Context, cmd any) error {
+			keyed, ok := cmd.(interface{ IdempotencyKey() string })
+			if !ok || keyed.IdempotencyKey() == "" {
+				return next(ctx, cmd)
+			}
+
+			key := "command:" + CommandName(cmd) + ":" + keyed.IdempotencyKey()
+			seen, err := store.Seen(ctx, key)
+			if err != nil {
+				return err
+			}
+			if seen {
+				return nil
+			}
+
+			if err := next(ctx, cmd); err != nil {
+				return err
+			}
+			return store.Mark(ctx, key)
+		}
+	}
+}
+
+func NewCommandBus() *CommandBus {
+	return &CommandBus{
+		handlers:     make(map[string]commandEntry),
+		remote:       make(map[string]bool),
+		replies:      &awaiters{pending: make(map[string]chan error)},
+		replyTimeout: defaultAwaitTimeout,
+	}
+}
@@ -0,0 +1,261 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type CompleteTask struct {
+	TaskId string `json:"taskId"`
+	Key    string `json:"key"`
+}
+
+func (c CompleteTask) Validate() error {
+	if c.TaskId == "" {
+		return errors.New("task id is required")
+	}
+	return nil
+}
+
+func (c CompleteTask) IdempotencyKey() string {
+	return c.Key
+}
+
+func TestCommandBus(t *testing.T) {
+	bus := common.NewCommandBus()
+
+	completed := 0
+	err := common.Handle(bus, func(ctx context.Context, cmd CompleteTask) error {
+		completed++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error registering handler: %v", err)
+	}
+
+	err = common.Handle(bus, func(ctx context.Context, cmd CompleteTask) error { return nil })
+	if !errors.Is(err, common.ErrCommandHandlerExists) {
+		t.Errorf("Second handler should be rejected: %v", err)
+	}
+
+	bus.Use(
+		common.CommandValidation,
+		common.CommandAuthorization(func(ctx context.Context, cmd any) bool {
+			_, ok := common.UserFromContext(ctx)
+			return ok
+		}),
+		common.CommandIdempotency(common.NewLRUDedupStore(10)),
+	)
+
+	user := context.WithValue(context.Background(), "user", 1)
+
+	if err := bus.Dispatch(context.Background(), CompleteTask{TaskId: "1"}); !errors.Is(err, common.ErrUnauthorized) {
+		t.Errorf("Command without a user should be unauthorized: %v", err)
+	}
+
+	if err := bus.Dispatch(user, CompleteTask{}); !errors.Is(err, common.ErrInvalidCommand) {
+		t.Errorf("Command without a task id should be invalid: %v", err)
+	}
+
+	bus.Dispatch(user, CompleteTask{TaskId: "1", Key: "k1"})
+	bus.Dispatch(user, CompleteTask{TaskId: "1", Key: "k1"})
+
+	if completed != 1 {
+		t.Errorf("Command with the same idempotency key should run once: %d", completed)
+	}
+
+	if err := bus.Dispatch(user, struct{ Name string }{}); !errors.Is(err, common.ErrNoCommandHandler) {
+		t.Errorf("Command without a handler should fail: %v", err)
+	}
+}
+
+type ArchiveTask struct {
+	TaskId string `json:"taskId"`
+}
+
+func (c ArchiveTask) CommandName() string {
+	return "archiveTask"
+}
+
+func TestCommandBusPointerCommand(t *testing.T) {
+	bus := common.NewCommandBus()
+
+	archived := ""
+	err := common.Handle(bus, func(ctx context.Context, cmd *ArchiveTask) error {
+		archived = cmd.TaskId
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error registering handler: %v", err)
+	}
+
+	if err := bus.Dispatch(context.Background(), &ArchiveTask{TaskId: "1"}); err != nil || archived != "1" {
+		t.Errorf("Pointer command was not handled: %q %v", archived, err)
+	}
+}
+
+// loopTransport delivers every posted event to each connected service,
+// signed with signer when it is set.
+type loopTransport struct {
+	mu       sync.Mutex
+	services []common.EventService[*common.BaseEntity[string], string]
+	signer   common.Signer
+}
+
+func (t *loopTransport) Connect(context.Context) error {
+	return nil
+}
+
+func (t *loopTransport) PostEvent(e common.Event) error {
+	if err := common.SignEvent(&e, t.signer); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, es := range t.services {
+		go es.HandleEvent(context.Background(), e)
+	}
+	return nil
+}
+
+func (t *loopTransport) NextEvent() (*common.Event, error) {
+	return nil, nil
+}
+
+func (t *loopTransport) connect(es common.EventService[*common.BaseEntity[string], string]) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.services = append(t.services, es)
+}
+
+func TestCommandBusRemote(t *testing.T) {
+	trans := &loopTransport{}
+
+	tasks := common.NewCommandBus()
+	tasks.SetTransport(trans)
+	common.Handle(tasks, func(ctx context.Context, cmd CompleteTask) error {
+		if cmd.TaskId == "missing" {
+			return errors.New("task not found")
+		}
+		return nil
+	})
+
+	tasksService := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "task")
+	tasks.Register(tasksService)
+	trans.connect(tasksService)
+
+	logs := common.NewCommandBus()
+	logs.SetTransport(trans)
+	logs.SetReplyTimeout(time.Second)
+	logs.Remote("CompleteTask")
+
+	logsService := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "log")
+	logs.Register(logsService)
+	trans.connect(logsService)
+
+	if err := logs.Dispatch(context.Background(), CompleteTask{TaskId: "1"}); err != nil {
+		t.Errorf("Remote command failed: %v", err)
+	}
+
+	err := logs.Dispatch(context.Background(), CompleteTask{TaskId: "missing"})
+
+	var remoteErr *common.RemoteCommandError
+	if !errors.As(err, &remoteErr) || remoteErr.Command != "CompleteTask" {
+		t.Errorf("Remote failure should be returned: %v", err)
+	}
+}
+
+func TestCommandBusRemoteActor(t *testing.T) {
+	key := []byte("secret")
+	keys := common.NewTrustedKeys()
+	keys.AddHMACKey("k1", key)
+
+	remoteBuses := func(trans *loopTransport) *common.CommandBus {
+		tasks := common.NewCommandBus()
+		tasks.SetTransport(trans)
+		tasks.SetVerifier(&common.EventVerifier{Keys: keys})
+		tasks.Use(common.CommandAuthorization(func(ctx context.Context, cmd any) bool {
+			userId, ok := common.UserFromContext(ctx)
+			return ok && userId == 7
+		}))
+		common.Handle(tasks, func(ctx context.Context, cmd CompleteTask) error { return nil })
+
+		tasksService := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "task")
+		tasks.Register(tasksService)
+		trans.connect(tasksService)
+
+		logs := common.NewCommandBus()
+		logs.SetTransport(trans)
+		logs.SetReplyTimeout(time.Second)
+		logs.Remote("CompleteTask")
+
+		logsService := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "log")
+		logs.Register(logsService)
+		trans.connect(logsService)
+		return logs
+	}
+
+	user := context.WithValue(context.Background(), "user", 7)
+	var remoteErr *common.RemoteCommandError
+
+	signed := remoteBuses(&loopTransport{signer: common.NewHMACSigner("k1", key)})
+	if err := signed.Dispatch(user, CompleteTask{TaskId: "1"}); err != nil {
+		t.Errorf("Signed remote command should run as its sender: %v", err)
+	}
+	if err := signed.Dispatch(context.Background(), CompleteTask{TaskId: "1"}); !errors.As(err, &remoteErr) {
+		t.Errorf("Anonymous remote command should be unauthorized: %v", err)
+	}
+
+	unsigned := remoteBuses(&loopTransport{})
+	if err := unsigned.Dispatch(user, CompleteTask{TaskId: "1"}); !errors.As(err, &remoteErr) {
+		t.Errorf("Unsigned remote command should run anonymously: %v", err)
+	}
+
+	forged := remoteBuses(&loopTransport{signer: common.NewHMACSigner("k1", []byte("guess"))})
+	if err := forged.Dispatch(user, CompleteTask{TaskId: "1"}); !errors.As(err, &remoteErr) {
+		t.Errorf("Remote command with a bad signature should run anonymously: %v", err)
+	}
+}
+
+type ArchiveLog struct {
+	LogId string `json:"logId"`
+}
+
+func TestCommandBusRemoteCommandWaitsOnRunner(t *testing.T) {
+	trans := newChanTransport()
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+
+	// archiving a log completes its task through another remote command,
+	// whose reply is delivered by the runner the first command came from.
+	tasks := common.NewCommandBus()
+	tasks.SetTransport(trans)
+	common.Handle(tasks, func(ctx context.Context, cmd CompleteTask) error { return nil })
+	tasks.Register(es)
+
+	client := common.NewCommandBus()
+	client.SetTransport(trans)
+	client.SetReplyTimeout(time.Second)
+	client.Remote("CompleteTask", "ArchiveLog")
+	client.Register(es)
+
+	logs := common.NewCommandBus()
+	logs.SetTransport(trans)
+	common.Handle(logs, func(ctx context.Context, cmd ArchiveLog) error {
+		return client.Dispatch(ctx, CompleteTask{TaskId: cmd.LogId})
+	})
+	logs.Register(es)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es.StartEventRunner(ctx)
+
+	if err := client.Dispatch(ctx, ArchiveLog{LogId: "1"}); err != nil {
+		t.Errorf("Remote command waiting on the runner failed: %v", err)
+	}
+}
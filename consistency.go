@@ -0,0 +1,225 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ConsistencyMode controls when Create, Save and Delete return relative to
+// the service's own repository being updated.
+type ConsistencyMode int
+
+const (
+	// ConsistencyEventual only posts the event. The repository is updated
+	// when the event runner receives it back from the stream.
+	ConsistencyEventual ConsistencyMode = iota
+	// ConsistencyLocalApply handles the event straight away and then posts
+	// it. The echo from the stream is skipped. If the event cannot be posted
+	// the repository change is undone, though subscribers that already ran
+	// are not. With an outbox the event is recorded before it is handled
+	// and released once the change is made, so neither is lost to a crash.
+	ConsistencyLocalApply
+	// ConsistencyAwait posts the event and waits for the event runner to
+	// handle it.
+	ConsistencyAwait
+)
+
+func (m ConsistencyMode) String() string {
+	switch m {
+	case ConsistencyLocalApply:
+		return "local-apply"
+	case ConsistencyAwait:
+		return "await"
+	default:
+		return "eventual"
+	}
+}
+
+const (
+	defaultAwaitTimeout = 5 * time.Second
+	echoCapacity        = 10000
+)
+
+// ErrAwaitTimeout is returned in await mode when the event was posted but was
+// not handled in time. It may still be handled later.
+var ErrAwaitTimeout = errors.New("timed out waiting for event to be handled")
+
+// awaiters holds a channel for every event a mutation is waiting on.
+type awaiters struct {
+	mu      sync.Mutex
+	pending map[string]chan error
+}
+
+func (a *awaiters) add(eventId string) chan error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ch := make(chan error, 1)
+	a.pending[eventId] = ch
+	return ch
+}
+
+func (a *awaiters) remove(eventId string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, eventId)
+}
+
+func (a *awaiters) done(eventId string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ch, ok := a.pending[eventId]; ok {
+		ch <- err
+		delete(a.pending, eventId)
+	}
+}
+
+// SetConsistency sets the consistency mode for Create, Save and Delete. In
+// await mode they give up after timeout, or 5 seconds if timeout is 0. Await
+// mode needs the event runner to be running.
+func (es *EventServiceImpl[T, S]) SetConsistency(mode ConsistencyMode, timeout time.Duration) {
+	es.consistency = mode
+	es.awaitTimeout = timeout
+	if es.awaitTimeout <= 0 {
+		es.awaitTimeout = defaultAwaitTimeout
+	}
+
+	if mode == ConsistencyLocalApply && es.echoes == nil {
+		es.echoes = NewLRUDedupStore(echoCapacity)
+	}
+	if mode == ConsistencyAwait && es.awaiting == nil {
+		es.awaiting = &awaiters{pending: make(map[string]chan error)}
+	}
+}
+
+// publish posts event, the change to e, according to the consistency mode.
+func (es *EventServiceImpl[T, S]) publish(ctx context.Context, event Event, e T) error {
+	switch es.consistency {
+	case ConsistencyLocalApply:
+		if es.outbox != nil {
+			return es.applyWithOutbox(ctx, event)
+		}
+
+		undo, err := es.undoer(ctx, e.GetID())
+		if err != nil {
+			return err
+		}
+
+		// The service's own events need no verification and are not signed
+		// until they are posted.
+		if err := es.handle(ctx, event); err != nil {
+			return err
+		}
+		es.echoes.Mark(ctx, event.EventId)
+
+		if err := es.send(ctx, event); err != nil {
+			if undoErr := undo(); undoErr != nil {
+				return errors.Join(err, fmt.Errorf("undoing local change to %v: %w", e.GetID(), undoErr))
+			}
+			return err
+		}
+		return nil
+
+	case ConsistencyAwait:
+		handled := es.awaiting.add(event.EventId)
+		defer es.awaiting.remove(event.EventId)
+
+		if err := es.send(ctx, event); err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(es.awaitTimeout)
+		defer timer.Stop()
+
+		select {
+		case err := <-handled:
+			if err != nil {
+				return fmt.Errorf("handling event %s: %w", event.EventId, err)
+			}
+			return nil
+		case <-timer.C:
+			return ErrAwaitTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+	default:
+		return es.send(ctx, event)
+	}
+}
+
+// applyWithOutbox records event in the outbox, held, before handling it
+// locally, so the event survives a crash after the change is made.
+func (es *EventServiceImpl[T, S]) applyWithOutbox(ctx context.Context, event Event) error {
+	entry, err := es.outbox.hold(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	if err := es.handle(ctx, event); err != nil {
+		return errors.Join(err, es.outbox.discard(ctx, entry))
+	}
+	es.echoes.Mark(ctx, event.EventId)
+
+	// The change is made and the event is recorded; if it cannot be released
+	// it is published when the hold expires.
+	if err := es.outbox.release(ctx, entry); err != nil {
+		slog.Error("Error releasing outbox entry", "EventId", event.EventId, "error", err)
+	}
+	return nil
+}
+
+// undoer returns a func that puts the entity with id back as it is now.
+func (es *EventServiceImpl[T, S]) undoer(ctx context.Context, id S) (func() error, error) {
+	existed, err := es.Repository.Exists(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var old T
+	if existed {
+		if old, err = es.Repository.Get(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() error {
+		exists, err := es.Repository.Exists(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case existed && exists:
+			return es.Repository.Save(ctx, old)
+		case existed:
+			return es.Repository.Create(ctx, old)
+		case exists:
+			current, err := es.Repository.Get(ctx, id)
+			if err != nil {
+				return err
+			}
+			return es.Repository.Delete(ctx, current)
+		}
+		return nil
+	}, nil
+}
+
+// isEcho reports whether event was already applied locally by a mutation.
+func (es *EventServiceImpl[T, S]) isEcho(ctx context.Context, event Event) bool {
+	if es.echoes == nil || event.EventId == "" {
+		return false
+	}
+	seen, _ := es.echoes.Seen(ctx, event.EventId)
+	return seen
+}
+
+// eventHandled wakes a mutation waiting on event in await mode.
+func (es *EventServiceImpl[T, S]) eventHandled(event Event, err error) {
+	if es.awaiting != nil {
+		es.awaiting.done(event.EventId, err)
+	}
+}
@@ -0,0 +1,126 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestConsistencyLocalApply(t *testing.T) {
+	trans := &tenantTransport{}
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	es.SetConsistency(common.ConsistencyLocalApply, 0)
+
+	ctx := context.Background()
+
+	if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	ok, _ := es.Exists(ctx, "1")
+	if !ok {
+		t.Errorf("Entity should be readable straight after Create")
+	}
+
+	if err := es.HandleEvent(ctx, trans.events[0]); err != nil {
+		t.Errorf("Echoed event should be skipped: %v", err)
+	}
+
+	if es.DuplicatesSkipped() != 1 {
+		t.Errorf("Echoed event was not counted as a duplicate: %d", es.DuplicatesSkipped())
+	}
+
+	if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err == nil {
+		t.Errorf("Creating an existing entity should fail")
+	}
+
+	if len(trans.events) != 1 {
+		t.Errorf("Failed mutation should not be posted: %d", len(trans.events))
+	}
+}
+
+func TestConsistencyAwait(t *testing.T) {
+	trans := newChanTransport()
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	es.SetConsistency(common.ConsistencyAwait, time.Second)
+
+	runner := es.StartEventRunner(context.Background())
+	defer runner.Stop(context.Background())
+
+	ctx := context.Background()
+
+	if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	ok, _ := es.Exists(ctx, "1")
+	if !ok {
+		t.Errorf("Entity should be readable straight after Create")
+	}
+}
+
+func TestConsistencyAwaitTimeout(t *testing.T) {
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), newChanTransport(), "test")
+	es.SetConsistency(common.ConsistencyAwait, 20*time.Millisecond)
+
+	err := es.Create(context.Background(), &common.BaseEntity[string]{ID: "1"})
+	if !errors.Is(err, common.ErrAwaitTimeout) {
+		t.Errorf("Create should time out without a runner: %v", err)
+	}
+}
+
+func TestConsistencyLocalApplyWithVerifier(t *testing.T) {
+	for _, policy := range []common.VerifyPolicy{common.VerifyReject, common.VerifyQuarantine} {
+		es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), &tenantTransport{}, "test")
+		es.SetConsistency(common.ConsistencyLocalApply, 0)
+		es.SetVerifier(&common.EventVerifier{Policy: policy, Quarantine: func(common.Event, error) {}})
+
+		ctx := context.Background()
+
+		// The service's own events are applied before they are signed.
+		if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err != nil {
+			t.Fatalf("Error creating entity: %v", err)
+		}
+
+		if ok, _ := es.Exists(ctx, "1"); !ok {
+			t.Errorf("Entity was not applied locally under policy %d", policy)
+		}
+	}
+}
+
+func TestConsistencyLocalApplyUndoesUnpublishedChanges(t *testing.T) {
+	trans := &flakyTransport{}
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	es.SetConsistency(common.ConsistencyLocalApply, 0)
+
+	ctx := context.Background()
+
+	trans.failures = 1
+	if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err == nil {
+		t.Fatal("Create should fail when the event cannot be posted")
+	}
+	if ok, _ := es.Exists(ctx, "1"); ok {
+		t.Errorf("Create was not undone")
+	}
+
+	es.Create(ctx, &common.BaseEntity[string]{ID: "2", Version: 1})
+
+	trans.failures = 1
+	if err := es.Save(ctx, &common.BaseEntity[string]{ID: "2", Version: 2}); err == nil {
+		t.Fatal("Save should fail when the event cannot be posted")
+	}
+	if e, _ := es.Get(ctx, "2"); e == nil || e.Version != 1 {
+		t.Errorf("Save was not undone: %+v", e)
+	}
+
+	trans.failures = 1
+	if err := es.Delete(ctx, &common.BaseEntity[string]{ID: "2", Version: 1}); err == nil {
+		t.Fatal("Delete should fail when the event cannot be posted")
+	}
+	if ok, _ := es.Exists(ctx, "2"); !ok {
+		t.Errorf("Delete was not undone")
+	}
+}
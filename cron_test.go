@@ -0,0 +1,43 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestCronNext(t *testing.T) {
+	// Sunday 10 March 2024.
+	from := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 10, 12, 1, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC)},
+		{"30 8 1 * *", time.Date(2024, 4, 1, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 18 1-5 6 *", time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		cron, err := common.ParseCron(tt.spec)
+		if err != nil {
+			t.Errorf("%s: error parsing: %v", tt.spec, err)
+			continue
+		}
+		if got := cron.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: next is %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := common.ParseCron(spec); err == nil {
+			t.Errorf("%s: should not parse", spec)
+		}
+	}
+}
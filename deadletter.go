@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	// ErrDeadLetterFailed stops the event runner when an event that failed
+	// could not be added to the dead letter store, even after retrying.
+	ErrDeadLetterFailed = errors.New("event could not be dead lettered")
+)
+
+// RetryPolicy controls how often the event runner calls a failing handler
+// before giving up on an event.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     func(attempt int) time.Duration
+}
+
+func (p RetryPolicy) attempts() int {
+	return max(p.MaxAttempts, 1)
+}
+
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff(attempt)
+}
+
+// DeadLetter is an event whose handler still failed after the last attempt.
+type DeadLetter struct {
+	BaseEntity[string]
+	Event         Event     `json:"event"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt"`
+}
+
+type DeadLetterStore interface {
+	Add(ctx context.Context, dl *DeadLetter) error
+	Update(ctx context.Context, dl *DeadLetter) error
+	List(ctx context.Context) ([]*DeadLetter, error)
+	Get(ctx context.Context, id string) (*DeadLetter, error)
+	Remove(ctx context.Context, id string) error
+}
+
+// RepositoryDeadLetterStore keeps dead letters in any repository, so they can
+// live in memory, in memcache or on disk.
+type RepositoryDeadLetterStore struct {
+	repo Repository[*DeadLetter, string]
+}
+
+func (s *RepositoryDeadLetterStore) Add(ctx context.Context, dl *DeadLetter) error {
+	exists, err := s.repo.Exists(ctx, dl.ID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return s.repo.Save(ctx, dl)
+	}
+	return s.repo.Create(ctx, dl)
+}
+
+func (s *RepositoryDeadLetterStore) Update(ctx context.Context, dl *DeadLetter) error {
+	return s.repo.Save(ctx, dl)
+}
+
+func (s *RepositoryDeadLetterStore) List(ctx context.Context) ([]*DeadLetter, error) {
+	return s.repo.GetAll(ctx)
+}
+
+func (s *RepositoryDeadLetterStore) Get(ctx context.Context, id string) (*DeadLetter, error) {
+	dl, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if dl == nil {
+		return nil, ErrDeadLetterNotFound
+	}
+	return dl, nil
+}
+
+func (s *RepositoryDeadLetterStore) Remove(ctx context.Context, id string) error {
+	dl, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.repo.Delete(ctx, dl)
+}
+
+func NewDeadLetterStore(repo Repository[*DeadLetter, string]) *RepositoryDeadLetterStore {
+	return &RepositoryDeadLetterStore{repo: repo}
+}
+
+func (es *EventServiceImpl[T, S]) SetRetryPolicy(policy RetryPolicy) {
+	es.retryPolicy = policy
+}
+
+func (es *EventServiceImpl[T, S]) SetDeadLetterStore(store DeadLetterStore) {
+	es.deadLetters = store
+}
+
+// handleWithRetry handles event according to the retry policy. Events that
+// still fail are added to the dead letter store, if there is one, retrying
+// that with the same policy, and the last error is returned. parked reports
+// whether the event is now in the dead letter store; if it could not be
+// added the error wraps ErrDeadLetterFailed.
+func (es *EventServiceImpl[T, S]) handleWithRetry(ctx context.Context, event Event) (parked bool, err error) {
+	first := time.Now()
+
+	ctx = withHandlerProgress(ctx)
+	attempts, err := retry(ctx, es.retryPolicy, func() error {
+		return es.HandleEvent(ctx, event)
+	})
+
+	// Events abandoned by a stopping runner are not dead lettered.
+	if err == nil || es.deadLetters == nil || ctx.Err() != nil {
+		return false, err
+	}
+
+	id := event.EventId
+	if id == "" {
+		id = NewEventId()
+	}
+
+	now := time.Now()
+	dl := &DeadLetter{
+		BaseEntity:    BaseEntity[string]{ID: id, CreationDate: now, LastUpdateDate: now, Version: 1},
+		Event:         event,
+		Error:         err.Error(),
+		Attempts:      attempts,
+		FirstFailedAt: first,
+		LastFailedAt:  now,
+	}
+	_, dlErr := retry(ctx, es.retryPolicy, func() error {
+		return es.deadLetters.Add(ctx, dl)
+	})
+	if dlErr != nil {
+		return false, errors.Join(err, fmt.Errorf("%w: adding dead letter %s: %w", ErrDeadLetterFailed, id, dlErr))
+	}
+	return true, err
+}
+
+func (es *EventServiceImpl[T, S]) DeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	if es.deadLetters == nil {
+		return nil, nil
+	}
+	return es.deadLetters.List(ctx)
+}
+
+func (es *EventServiceImpl[T, S]) DeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	if es.deadLetters == nil {
+		return nil, ErrDeadLetterNotFound
+	}
+	return es.deadLetters.Get(ctx, id)
+}
+
+// ReplayDeadLetter handles a dead letter's event again. On success the dead
+// letter is removed, otherwise its attempt count and error are updated.
+func (es *EventServiceImpl[T, S]) ReplayDeadLetter(ctx context.Context, id string) error {
+	dl, err := es.DeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = es.HandleEvent(ctx, dl.Event)
+	if err == nil {
+		return es.deadLetters.Remove(ctx, id)
+	}
+
+	dl.Attempts++
+	dl.Error = err.Error()
+	dl.LastFailedAt = time.Now()
+	dl.LastUpdateDate = dl.LastFailedAt
+	if uerr := es.deadLetters.Update(ctx, dl); uerr != nil {
+		slog.Error("Error updating dead letter", "EventId", id, "error", uerr)
+	}
+	return err
+}
+
+func (es *EventServiceImpl[T, S]) DiscardDeadLetter(ctx context.Context, id string) error {
+	if es.deadLetters == nil {
+		return ErrDeadLetterNotFound
+	}
+	return es.deadLetters.Remove(ctx, id)
+}
@@ -0,0 +1,192 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type chanTransport struct {
+	events chan common.Event
+}
+
+func (t *chanTransport) Connect(context.Context) error {
+	return nil
+}
+
+func (t *chanTransport) PostEvent(e common.Event) error {
+	t.events <- e
+	return nil
+}
+
+func (t *chanTransport) NextEvent() (*common.Event, error) {
+	select {
+	case e := <-t.events:
+		return &e, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, nil
+	}
+}
+
+func newChanTransport() *chanTransport {
+	return &chanTransport{events: make(chan common.Event, 100)}
+}
+
+func TestDeadLetters(t *testing.T) {
+	trans := newChanTransport()
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, trans, "test")
+
+	var calls atomic.Int32
+	var fixed atomic.Bool
+
+	es.SetHandlers(common.EventHandlers{
+		"testFailed": func(ctx context.Context, event common.Event) error {
+			calls.Add(1)
+			if fixed.Load() {
+				return nil
+			}
+			return errors.New("handler failed")
+		},
+	})
+	es.SetRetryPolicy(common.RetryPolicy{MaxAttempts: 3})
+	es.SetDeadLetterStore(common.NewDeadLetterStore(common.NewInMemoryRepository[*common.DeadLetter]()))
+	es.SetErrorHandler(func(err error, event *common.Event) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	es.StartEventRunner(ctx)
+
+	trans.PostEvent(common.Event{EventId: "1", EventType: "testFailed"})
+	trans.PostEvent(common.Event{EventId: "2", EventType: "testFailed"})
+
+	waitFor(t, "events to be dead lettered", func() bool {
+		return calls.Load() == 6
+	})
+
+	cancel()
+	waitFor(t, "runner to stop", func() bool {
+		return es.Status() == common.StatusStopped
+	})
+
+	dls, err := es.DeadLetters(context.Background())
+	if err != nil {
+		t.Fatalf("Error listing dead letters: %v", err)
+	}
+
+	if len(dls) != 2 {
+		t.Fatalf("Dead letter count is not correct: %d", len(dls))
+	}
+
+	dl, err := es.DeadLetter(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("Error getting dead letter: %v", err)
+	}
+
+	if dl.Attempts != 3 || dl.Error != "handler failed" || dl.Event.EventType != "testFailed" {
+		t.Errorf("Dead letter is not correct: %+v", dl)
+	}
+
+	if err := es.ReplayDeadLetter(context.Background(), "1"); err == nil {
+		t.Errorf("Replay should fail while the handler is broken")
+	}
+
+	dl, _ = es.DeadLetter(context.Background(), "1")
+	if dl.Attempts != 4 {
+		t.Errorf("Replay did not update the attempt count: %d", dl.Attempts)
+	}
+
+	fixed.Store(true)
+
+	if err := es.ReplayDeadLetter(context.Background(), "1"); err != nil {
+		t.Errorf("Error replaying dead letter: %v", err)
+	}
+
+	if err := es.DiscardDeadLetter(context.Background(), "2"); err != nil {
+		t.Errorf("Error discarding dead letter: %v", err)
+	}
+
+	dls, _ = es.DeadLetters(context.Background())
+	if len(dls) != 0 {
+		t.Errorf("Dead letters should be empty: %d", len(dls))
+	}
+
+	_, err = es.DeadLetter(context.Background(), "1")
+	if !errors.Is(err, common.ErrDeadLetterNotFound) {
+		t.Errorf("Replayed dead letter should be removed: %v", err)
+	}
+}
+
+func TestDefaultHandlersReturnRepositoryErrors(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "test")
+
+	es.Save(context.Background(), &common.BaseEntity[string]{ID: "missing"})
+
+	if err := es.HandleEvent(context.Background(), trans.events[0]); err == nil {
+		t.Errorf("Updating a missing entity should return an error")
+	}
+}
+
+type failingDeadLetterStore struct {
+	*common.RepositoryDeadLetterStore
+	adds atomic.Int32
+}
+
+func (s *failingDeadLetterStore) Add(ctx context.Context, dl *common.DeadLetter) error {
+	s.adds.Add(1)
+	return errors.New("store unavailable")
+}
+
+func TestDeadLetterFailureStopsRunner(t *testing.T) {
+	trans := newChanTransport()
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+
+	es.SetHandlers(common.EventHandlers{
+		"testFailed": func(ctx context.Context, event common.Event) error {
+			return errors.New("handler failed")
+		},
+		"testOther": func(ctx context.Context, event common.Event) error {
+			return nil
+		},
+	})
+	es.SetRetryPolicy(common.RetryPolicy{MaxAttempts: 3})
+	store := &failingDeadLetterStore{RepositoryDeadLetterStore: common.NewDeadLetterStore(common.NewInMemoryRepository[*common.DeadLetter]())}
+	es.SetDeadLetterStore(store)
+	es.SetErrorHandler(func(err error, event *common.Event) {})
+
+	checkpoints := common.NewInMemoryCheckpointStore()
+	es.SetCheckpointStore(checkpoints, "test", 1)
+
+	trans.PostEvent(common.Event{EventId: "1", EventType: "testOther"})
+	trans.PostEvent(common.Event{EventId: "2", EventType: "testFailed"})
+	trans.PostEvent(common.Event{EventId: "3", EventType: "testOther"})
+
+	runner := es.StartEventRunner(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- runner.Wait() }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, common.ErrDeadLetterFailed) {
+			t.Errorf("Runner should stop with the dead letter failure: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Runner kept going after an event could not be dead lettered")
+	}
+
+	if store.adds.Load() != 3 {
+		t.Errorf("Dead letter write was not retried with the retry policy: %d", store.adds.Load())
+	}
+
+	if lastId, _ := checkpoints.Load(context.Background(), "test"); lastId != "1" {
+		t.Errorf("Checkpoint should stop before the event that was not parked: %s", lastId)
+	}
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// DedupStore records the ids of events that have been handled so redelivered
+// events can be skipped.
+type DedupStore interface {
+	Seen(ctx context.Context, eventId string) (bool, error)
+	Mark(ctx context.Context, eventId string) error
+}
+
+// LRUDedupStore remembers the most recent capacity event ids in memory.
+type LRUDedupStore struct {
+	capacity int
+	order    *list.List
+	ids      map[string]*list.Element
+	mu       sync.Mutex
+}
+
+func (s *LRUDedupStore) Seen(ctx context.Context, eventId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.ids[eventId]
+	if ok {
+		s.order.MoveToFront(el)
+	}
+	return ok, nil
+}
+
+func (s *LRUDedupStore) Mark(ctx context.Context, eventId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.ids[eventId]; ok {
+		s.order.MoveToFront(el)
+		return nil
+	}
+
+	s.ids[eventId] = s.order.PushFront(eventId)
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+	return nil
+}
+
+func NewLRUDedupStore(capacity int) *LRUDedupStore {
+	return &LRUDedupStore{
+		capacity: capacity,
+		order:    list.New(),
+		ids:      make(map[string]*list.Element),
+	}
+}
+
+// MemcacheDedupStore keeps event ids in memcache so several instances of a
+// service share them. Ids expire after ttl.
+type MemcacheDedupStore struct {
+	client MemcacheClient
+	prefix string
+	ttl    time.Duration
+}
+
+func (s *MemcacheDedupStore) Seen(ctx context.Context, eventId string) (bool, error) {
+	item, err := s.client.Get(s.prefix + "dedup:" + eventId)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return item != nil, nil
+}
+
+func (s *MemcacheDedupStore) Mark(ctx context.Context, eventId string) error {
+	return s.client.Set(&memcache.Item{
+		Key:        s.prefix + "dedup:" + eventId,
+		Value:      []byte{1},
+		Expiration: memcacheExpiration(s.ttl, time.Now()),
+	})
+}
+
+// maxRelativeExpiration is the longest expiration memcache reads as seconds
+// from now. Longer ones are read as a Unix time.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// memcacheExpiration converts ttl to a memcache expiration. Zero means the
+// item does not expire.
+func memcacheExpiration(ttl time.Duration, now time.Time) int32 {
+	switch {
+	case ttl <= 0:
+		return 0
+	case ttl > maxRelativeExpiration:
+		return int32(now.Add(ttl).Unix())
+	default:
+		// Round up so short ttls do not become 0, which never expires.
+		return int32((ttl + time.Second - 1) / time.Second)
+	}
+}
+
+func NewMemcacheDedupStore(host string, prefix string, ttl time.Duration, mc MemcacheClient) *MemcacheDedupStore {
+	if mc == nil {
+		mc = memcache.New(host)
+	}
+	return &MemcacheDedupStore{
+		client: mc,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// FileDedupStore appends event ids to a file and loads them on start so
+// deduplication survives restarts. Like LRUDedupStore it remembers the most
+// recent capacity ids. The file is rewritten with just those once it holds
+// twice as many, so it does not grow without bound.
+type FileDedupStore struct {
+	path  string
+	ids   *LRUDedupStore
+	lines int
+	mu    sync.Mutex
+}
+
+func (s *FileDedupStore) Seen(ctx context.Context, eventId string) (bool, error) {
+	return s.ids.Seen(ctx, eventId)
+}
+
+func (s *FileDedupStore) Mark(ctx context.Context, eventId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok, _ := s.ids.Seen(ctx, eventId); ok {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(eventId + "\n"); err != nil {
+		return err
+	}
+	s.lines++
+
+	s.ids.Mark(ctx, eventId)
+
+	if s.lines > 2*s.ids.capacity {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with only the ids still remembered, oldest
+// first, and swaps it in with a rename so a crash leaves one file or the
+// other.
+func (s *FileDedupStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	s.ids.mu.Lock()
+	for el := s.ids.order.Back(); el != nil; el = el.Prev() {
+		w.WriteString(el.Value.(string) + "\n")
+	}
+	lines := s.ids.order.Len()
+	s.ids.mu.Unlock()
+
+	err = errors.Join(w.Flush(), f.Sync(), f.Close())
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compacting dedup file: %w", err)
+	}
+
+	s.lines = lines
+	return nil
+}
+
+// NewFileDedupStore opens the store kept at path, which remembers the most
+// recent capacity ids.
+func NewFileDedupStore(path string, capacity int) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		path: path,
+		ids:  NewLRUDedupStore(capacity),
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := scanner.Text(); id != "" {
+			s.ids.Mark(context.Background(), id)
+			s.lines++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.lines > 2*capacity {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,152 @@
+package common_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestLRUDedupStore(t *testing.T) {
+	ctx := context.Background()
+	store := common.NewLRUDedupStore(2)
+
+	store.Mark(ctx, "1")
+	store.Mark(ctx, "2")
+	store.Seen(ctx, "1")
+	store.Mark(ctx, "3")
+
+	if ok, _ := store.Seen(ctx, "1"); !ok {
+		t.Errorf("Recently used id should be kept")
+	}
+
+	if ok, _ := store.Seen(ctx, "2"); ok {
+		t.Errorf("Least recently used id should be evicted")
+	}
+}
+
+func TestFileDedupStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup")
+
+	store, err := common.NewFileDedupStore(path, 10)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	store.Mark(ctx, "1")
+
+	store, err = common.NewFileDedupStore(path, 10)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+
+	if ok, _ := store.Seen(ctx, "1"); !ok {
+		t.Errorf("Id should survive a restart")
+	}
+}
+
+func TestFileDedupStoreCapacity(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup")
+
+	store, _ := common.NewFileDedupStore(path, 2)
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		store.Mark(ctx, id)
+	}
+
+	if ok, _ := store.Seen(ctx, "1"); ok {
+		t.Errorf("Oldest id should be forgotten")
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines > 4 {
+		t.Errorf("File was not compacted: %d ids", lines)
+	}
+
+	store, err := common.NewFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	if ok, _ := store.Seen(ctx, "5"); !ok {
+		t.Errorf("Recent id should survive compaction and a restart")
+	}
+	if ok, _ := store.Seen(ctx, "3"); ok {
+		t.Errorf("Forgotten id should stay forgotten after a restart")
+	}
+}
+
+func TestMemcacheDedupStore(t *testing.T) {
+	ctx := context.Background()
+	store := common.NewMemcacheDedupStore("", "test", time.Hour, &MockMemcacheClient{store: make(map[string][]byte)})
+
+	if ok, _ := store.Seen(ctx, "1"); ok {
+		t.Errorf("Id should not be seen")
+	}
+
+	store.Mark(ctx, "1")
+
+	if ok, _ := store.Seen(ctx, "1"); !ok {
+		t.Errorf("Id should be seen")
+	}
+}
+
+func TestEventServiceDedup(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "test")
+	es.SetDedupStore(common.NewLRUDedupStore(100))
+
+	ctx := context.Background()
+
+	es.Create(ctx, &common.BaseEntity[string]{ID: "1"})
+	es.Save(ctx, &common.BaseEntity[string]{ID: "1", Version: 2})
+
+	// Deliver every event twice, as after a reconnect.
+	for _, ev := range append(trans.events, trans.events...) {
+		if err := es.HandleEvent(context.Background(), ev); err != nil {
+			t.Errorf("Error handling event: %v", err)
+		}
+	}
+
+	if es.DuplicatesSkipped() != 2 {
+		t.Errorf("Duplicates skipped is not correct: %d", es.DuplicatesSkipped())
+	}
+
+	e, _ := es.Get(ctx, "1")
+	if e == nil || e.Version != 2 {
+		t.Errorf("Entity is not correct: %+v", e)
+	}
+}
+
+type expiringMemcacheClient struct {
+	MockMemcacheClient
+	expiration int32
+}
+
+func (m *expiringMemcacheClient) Set(item *memcache.Item) error {
+	m.expiration = item.Expiration
+	return m.MockMemcacheClient.Set(item)
+}
+
+func TestMemcacheDedupStoreExpiration(t *testing.T) {
+	ctx := context.Background()
+
+	mc := &expiringMemcacheClient{MockMemcacheClient: MockMemcacheClient{store: make(map[string][]byte)}}
+
+	common.NewMemcacheDedupStore("", "test", time.Hour, mc).Mark(ctx, "1")
+	if mc.expiration != 3600 {
+		t.Errorf("Short ttl should be relative: %d", mc.expiration)
+	}
+
+	// Memcache reads anything over 30 days as a Unix time.
+	common.NewMemcacheDedupStore("", "test", 60*24*time.Hour, mc).Mark(ctx, "2")
+	want := time.Now().Add(60 * 24 * time.Hour).Unix()
+	if got := int64(mc.expiration); got < want-5 || got > want+5 {
+		t.Errorf("Long ttl should be an absolute time: %d, want about %d", got, want)
+	}
+}
@@ -0,0 +1,291 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	encryptedFieldPrefix = "enc:"
+	encryptTag           = "encrypt"
+)
+
+var encryptedMagic = []byte("CLE1")
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds the AES keys known to a service. Data is always written with
+// the current key and can be read with any key in the ring.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+	mu      sync.RWMutex
+}
+
+func (k *Keyring) AddKey(id string, key []byte) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = aead
+	return nil
+}
+
+// Rotate makes id the key used for new writes. Existing data stays readable
+// until it is rewritten, see Reencrypt.
+func (k *Keyring) Rotate(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	k.current = id
+	return nil
+}
+
+func (k *Keyring) CurrentKeyId() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Encrypt seals plaintext with the current key. The output is the magic
+// header, the key id length and key id, the nonce and the ciphertext.
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	k.mu.RLock()
+	id := k.current
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, encryptedMagic...)
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(id)), nil
+}
+
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, errors.New("data is not encrypted")
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	id := string(data[1 : 1+data[0]])
+	data = data[1+len(id):]
+
+	k.mu.RLock()
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(id))
+}
+
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+func NewKeyring(currentId string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		keys: make(map[string]cipher.AEAD),
+	}
+	for id, key := range keys {
+		if err := k.AddKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := k.Rotate(currentId); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// EncryptingCodec wraps another codec and encrypts either the whole payload
+// or only the string fields tagged `encrypt:"true"`. Plaintext written before
+// encryption was enabled is still readable.
+type EncryptingCodec struct {
+	inner  Codec
+	keys   *Keyring
+	fields bool
+}
+
+func (ec *EncryptingCodec) Marshal(v any) ([]byte, error) {
+	if ec.fields {
+		cp, err := transformFields(v, true, ec.encryptField)
+		if err != nil {
+			return nil, err
+		}
+		return ec.inner.Marshal(cp)
+	}
+
+	b, err := ec.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return ec.keys.Encrypt(b)
+}
+
+func (ec *EncryptingCodec) Unmarshal(data []byte, v any) error {
+	if ec.fields {
+		if err := ec.inner.Unmarshal(data, v); err != nil {
+			return err
+		}
+		_, err := transformFields(v, false, ec.decryptField)
+		return err
+	}
+
+	if IsEncrypted(data) {
+		var err error
+		data, err = ec.keys.Decrypt(data)
+		if err != nil {
+			return err
+		}
+	}
+	return ec.inner.Unmarshal(data, v)
+}
+
+func (ec *EncryptingCodec) encryptField(s string) (string, error) {
+	b, err := ec.keys.Encrypt([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return encryptedFieldPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (ec *EncryptingCodec) decryptField(s string) (string, error) {
+	if !strings.HasPrefix(s, encryptedFieldPrefix) {
+		return s, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedFieldPrefix))
+	if err != nil {
+		return "", err
+	}
+	b, err = ec.keys.Decrypt(b)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// transformFields applies fn to every tagged field of the struct behind v.
+// With clone set, v is copied first so the caller's entity keeps its
+// plaintext, otherwise the fields are rewritten in place.
+func transformFields(v any, clone bool, fn func(string) (string, error)) (any, error) {
+	rv := reflect.ValueOf(v)
+	if !clone && rv.Kind() != reflect.Pointer {
+		return v, nil
+	}
+
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return v, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return v, nil
+	}
+
+	target := rv
+	if clone {
+		target = reflect.New(rv.Type()).Elem()
+		target.Set(rv)
+	}
+
+	if err := transformStruct(target, fn); err != nil {
+		return nil, err
+	}
+
+	if clone {
+		return target.Addr().Interface(), nil
+	}
+	return v, nil
+}
+
+func transformStruct(rv reflect.Value, fn func(string) (string, error)) error {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := rv.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if fv.Kind() == reflect.Struct {
+			if err := transformStruct(fv, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Tag.Get(encryptTag) != "true" || fv.Kind() != reflect.String {
+			continue
+		}
+		s, err := fn(fv.String())
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		fv.SetString(s)
+	}
+	return nil
+}
+
+// Reencrypt rewrites every entity in repo so it is stored with the current
+// key. It is Migrate under another name, since repositories always write
+// with the current key.
+func Reencrypt[T Entity[S], S comparable](ctx context.Context, repo Repository[T, S]) (int, error) {
+	return Migrate(ctx, repo)
+}
+
+// ReencryptInBackground runs Reencrypt on its own goroutine and reports the
+// result on the returned channel.
+func ReencryptInBackground[T Entity[S], S comparable](ctx context.Context, repo Repository[T, S]) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := Reencrypt(ctx, repo)
+		done <- err
+	}()
+	return done
+}
+
+func NewEncryptingCodec(inner Codec, keys *Keyring) *EncryptingCodec {
+	return &EncryptingCodec{inner: inner, keys: keys}
+}
+
+func NewFieldEncryptingCodec(inner Codec, keys *Keyring) *EncryptingCodec {
+	return &EncryptingCodec{inner: inner, keys: keys, fields: true}
+}
@@ -0,0 +1,120 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type PersonalNote struct {
+	common.BaseEntity[string]
+	Title string `json:"title"`
+	Body  string `json:"body" encrypt:"true"`
+}
+
+func testKeyring(t *testing.T) *common.Keyring {
+	keys, err := common.NewKeyring("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	})
+	if err != nil {
+		t.Fatalf("Error creating keyring: %v", err)
+	}
+	return keys
+}
+
+func TestEncryptingCodecMemcache(t *testing.T) {
+	keys := testKeyring(t)
+	mc := &FlaggedMemcacheClient{store: make(map[string]*memcache.Item)}
+
+	repo := common.NewMemcacheRepository[*PersonalNote]("", "note", mc)
+	repo.(*common.MemcacheRepository[*PersonalNote, string]).SetCodec(common.NewEncryptingCodec(common.GobCodec{}, keys))
+
+	ctx := context.Background()
+
+	err := repo.Create(ctx, &PersonalNote{BaseEntity: common.BaseEntity[string]{ID: "1"}, Body: "secret"})
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	if bytes.Contains(mc.store["note1"].Value, []byte("secret")) {
+		t.Errorf("Payload is stored in plaintext")
+	}
+
+	keys.Rotate("k2")
+
+	n, err := repo.Get(ctx, "1")
+	if err != nil {
+		t.Fatalf("Error reading with rotated key: %v", err)
+	}
+
+	if n.Body != "secret" {
+		t.Errorf("Body is not correct: %s", n.Body)
+	}
+
+	if err := <-common.ReencryptInBackground(ctx, repo); err != nil {
+		t.Fatalf("Error re-encrypting: %v", err)
+	}
+
+	if !bytes.Contains(mc.store["note1"].Value, []byte("k2")) {
+		t.Errorf("Entity was not re-encrypted with the current key")
+	}
+}
+
+func TestFieldEncryptingCodecFile(t *testing.T) {
+	keys := testKeyring(t)
+	dir := t.TempDir()
+
+	repo := common.NewFileRepository[*PersonalNote](dir, "note")
+	repo.(*common.FileRepository[*PersonalNote, string]).SetCodec(common.NewFieldEncryptingCodec(common.JSONCodec{}, keys))
+
+	ctx := context.Background()
+
+	note := &PersonalNote{BaseEntity: common.BaseEntity[string]{ID: "1"}, Title: "kitchen", Body: "secret"}
+
+	err := repo.Create(ctx, note)
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	if note.Body != "secret" {
+		t.Errorf("Caller's entity was modified: %s", note.Body)
+	}
+
+	b, _ := os.ReadFile(filepath.Join(dir, "note", "1.dat"))
+
+	if bytes.Contains(b, []byte("secret")) {
+		t.Errorf("Tagged field is stored in plaintext")
+	}
+
+	if !bytes.Contains(b, []byte("kitchen")) {
+		t.Errorf("Untagged field should not be encrypted")
+	}
+
+	n, err := repo.Get(ctx, "1")
+	if err != nil {
+		t.Fatalf("Error getting entity: %v", err)
+	}
+
+	if n.Body != "secret" {
+		t.Errorf("Body is not correct: %s", n.Body)
+	}
+}
+
+func TestKeyringUnknownKey(t *testing.T) {
+	keys := testKeyring(t)
+
+	data, _ := keys.Encrypt([]byte("secret"))
+
+	other, _ := common.NewKeyring("k3", map[string][]byte{"k3": bytes.Repeat([]byte{3}, 32)})
+
+	_, err := other.Decrypt(data)
+	if err == nil {
+		t.Errorf("Decrypting with an unknown key should fail")
+	}
+}
@@ -0,0 +1,49 @@
+package common
+
+import "context"
+
+func WithCorrelationId(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, "correlationId", correlationId)
+}
+
+func CorrelationIdFromContext(ctx context.Context) string {
+	correlationId, _ := ctx.Value("correlationId").(string)
+	return correlationId
+}
+
+func WithCausationId(ctx context.Context, causationId string) context.Context {
+	return context.WithValue(ctx, "causationId", causationId)
+}
+
+func CausationIdFromContext(ctx context.Context) string {
+	causationId, _ := ctx.Value("causationId").(string)
+	return causationId
+}
+
+// WithEventMetadata adds a header that is copied into the metadata of every
+// event published with ctx.
+func WithEventMetadata(ctx context.Context, key, value string) context.Context {
+	md := map[string]string{}
+	for k, v := range EventMetadataFromContext(ctx) {
+		md[k] = v
+	}
+	md[key] = value
+	return context.WithValue(ctx, "eventMetadata", md)
+}
+
+func EventMetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value("eventMetadata").(map[string]string)
+	return md
+}
+
+// EventContext returns a context for handling event. Events published from
+// it share the event's tenant and correlation id and name the event as their
+// cause.
+func EventContext(ctx context.Context, event Event) context.Context {
+	ctx = WithTenant(ctx, event.TenantId)
+	ctx = WithCausationId(ctx, event.EventId)
+	if event.CorrelationId != "" {
+		ctx = WithCorrelationId(ctx, event.CorrelationId)
+	}
+	return ctx
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// eventIdGenerator produces ULIDs: 48 bits of millisecond timestamp followed
+// by 80 random bits, encoded as 26 Crockford base32 characters. Ids generated
+// in the same millisecond increment the random part so they stay ordered.
+type eventIdGenerator struct {
+	lastMs  uint64
+	entropy [10]byte
+	mu      sync.Mutex
+}
+
+var eventIds = &eventIdGenerator{}
+
+func (g *eventIdGenerator) next(t time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(t.UnixMilli())
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		g.increment()
+	} else {
+		g.lastMs = ms
+		rand.Read(g.entropy[:])
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	copy(id[6:], g.entropy[:])
+
+	return encodeULID(id)
+}
+
+func (g *eventIdGenerator) increment() {
+	for i := len(g.entropy) - 1; i >= 0; i-- {
+		g.entropy[i]++
+		if g.entropy[i] != 0 {
+			return
+		}
+	}
+}
+
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+
+	var out [26]byte
+	// 128 bits are encoded as 130 bits with two leading zero bits.
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// NewEventId returns a unique, lexicographically time ordered event id.
+func NewEventId() string {
+	return eventIds.next(time.Now())
+}
@@ -0,0 +1,71 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestNewEventId(t *testing.T) {
+	seen := map[string]bool{}
+	last := ""
+
+	for i := 0; i < 10000; i++ {
+		id := common.NewEventId()
+
+		if len(id) != 26 {
+			t.Fatalf("Event id length is not correct: %s", id)
+		}
+
+		if seen[id] {
+			t.Fatalf("Duplicate event id: %s", id)
+		}
+		seen[id] = true
+
+		if id <= last {
+			t.Fatalf("Event ids are not ordered: %s <= %s", id, last)
+		}
+		last = id
+	}
+}
+
+func TestEventEnvelope(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "task")
+
+	ctx := context.WithValue(context.Background(), "user", 7)
+	ctx = common.WithCorrelationId(ctx, "corr-1")
+	ctx = common.WithCausationId(ctx, "cause-1")
+	ctx = common.WithEventMetadata(ctx, "source", "web")
+
+	es.Create(ctx, &common.BaseEntity[string]{ID: "t1", Version: 3})
+	es.Save(context.Background(), &common.BaseEntity[string]{ID: "t1", Version: 4})
+
+	ev := trans.events[0]
+
+	if ev.AggregateId != "t1" || ev.AggregateType != "task" || ev.AggregateSequence != 3 {
+		t.Errorf("Aggregate fields are not correct: %+v", ev)
+	}
+
+	if ev.CorrelationId != "corr-1" || ev.CausationId != "cause-1" {
+		t.Errorf("Correlation fields are not correct: %+v", ev)
+	}
+
+	if ev.Actor != "7" {
+		t.Errorf("Actor is not correct: %s", ev.Actor)
+	}
+
+	if ev.Metadata["source"] != "web" {
+		t.Errorf("Metadata is not correct: %v", ev.Metadata)
+	}
+
+	if trans.events[1].CorrelationId != trans.events[1].EventId {
+		t.Errorf("Event without a correlation id should start a new correlation: %+v", trans.events[1])
+	}
+
+	if trans.events[1].EventId <= ev.EventId {
+		t.Errorf("Event ids are not ordered")
+	}
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type EventMiddleware func(EventHandler) EventHandler
+
+func CreateEventMiddleware(mw ...EventMiddleware) EventMiddleware {
+	return func(h EventHandler) EventHandler {
+		for i := range mw {
+			h = mw[len(mw)-1-i](h)
+		}
+		return h
+	}
+}
+
+func EventLogging(next EventHandler) EventHandler {
+	return func(ctx context.Context, event Event) error {
+		start := time.Now()
+
+		err := next(ctx, event)
+
+		if err != nil {
+			slog.Error("Event", "EventType", event.EventType, "EventId", event.EventId, slog.Duration("Taken", time.Since(start)), "Error", err)
+		} else {
+			slog.Info("Event", "EventType", event.EventType, "EventId", event.EventId, slog.Duration("Taken", time.Since(start)))
+		}
+		return err
+	}
+}
+
+func EventRecover(next EventHandler) EventHandler {
+	return func(ctx context.Context, event Event) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Recovered from panic", "Error", r, "EventId", event.EventId)
+				err = fmt.Errorf("panic handling event %s: %v", event.EventId, r)
+			}
+		}()
+		return next(ctx, event)
+	}
+}
+
+// EventTimeout cancels the handler's context after d. A handler that ignores
+// its context keeps running, but the event is reported as failed.
+func EventTimeout(d time.Duration) EventMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event Event) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- next(ctx, event)
+			}()
+
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return fmt.Errorf("handling event %s: %w", event.EventId, ctx.Err())
+			}
+		}
+	}
+}
+
+// EventTracing gives the handler a context that carries the event's tenant,
+// correlation and causation ids, so events it publishes join the same trace.
+func EventTracing(next EventHandler) EventHandler {
+	return func(ctx context.Context, event Event) error {
+		ctx = EventContext(ctx, event)
+		slog.Debug("Event", "EventId", event.EventId, "CorrelationId", event.CorrelationId, "CausationId", event.CausationId)
+		return next(ctx, event)
+	}
+}
+
+func EventRetry(policy RetryPolicy) EventMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event Event) error {
+			_, err := retry(ctx, policy, func() error {
+				return next(ctx, event)
+			})
+			return err
+		}
+	}
+}
+
+func EventIdempotency(store DedupStore) EventMiddleware {
+	return idempotent(store, nil)
+}
+
+// idempotent skips events whose id is in store and records the id once the
+// handler succeeds. skipped is called for every skipped event.
+func idempotent(store DedupStore, skipped func(event Event)) EventMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event Event) error {
+			if event.EventId == "" {
+				return next(ctx, event)
+			}
+
+			seen, err := store.Seen(ctx, event.EventId)
+			if err != nil {
+				return err
+			}
+			if seen {
+				if skipped != nil {
+					skipped(event)
+				}
+				return nil
+			}
+
+			if err := next(ctx, event); err != nil {
+				return err
+			}
+			return store.Mark(ctx, event.EventId)
+		}
+	}
+}
+
+// retry calls fn until it succeeds or the policy's attempts are used up and
+// returns the number of attempts made. Permanent errors are never retried.
+func retry(ctx context.Context, policy RetryPolicy, fn func() error) (int, error) {
+	var err error
+	attempts := 0
+
+	for attempts < policy.attempts() {
+		if attempts > 0 {
+			select {
+			case <-ctx.Done():
+				return attempts, ctx.Err()
+			case <-time.After(policy.wait(attempts)):
+			}
+		}
+
+		attempts++
+		err = fn()
+		if err == nil || permanent(err) {
+			break
+		}
+	}
+	return attempts, err
+}
+
+// permanent reports whether err fails the same way however often the event
+// is retried: it failed its integrity check or its payload does not decode.
+func permanent(err error) bool {
+	var decodeErr *EventDecodeError
+	return errors.Is(err, ErrEventIntegrity) || errors.As(err, &decodeErr)
+}
+
+type EventTypeMetrics struct {
+	Handled  uint64
+	Failed   uint64
+	Duration time.Duration
+}
+
+// EventMetrics counts handled and failed events and the time spent handling
+// them, per event type.
+type EventMetrics struct {
+	types map[string]*EventTypeMetrics
+	mu    sync.Mutex
+}
+
+func (m *EventMetrics) Middleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event Event) error {
+		start := time.Now()
+		err := next(ctx, event)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		tm, ok := m.types[event.EventType]
+		if !ok {
+			tm = &EventTypeMetrics{}
+			m.types[event.EventType] = tm
+		}
+		tm.Handled++
+		if err != nil {
+			tm.Failed++
+		}
+		tm.Duration += time.Since(start)
+
+		return err
+	}
+}
+
+func (m *EventMetrics) Snapshot() map[string]EventTypeMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]EventTypeMetrics, len(m.types))
+	for k, v := range m.types {
+		snapshot[k] = *v
+	}
+	return snapshot
+}
+
+func NewEventMetrics() *EventMetrics {
+	return &EventMetrics{
+		types: make(map[string]*EventTypeMetrics),
+	}
+}
+
+// Use adds middleware that wraps the handler of every event type.
+func (es *EventServiceImpl[T, S]) Use(mw ...EventMiddleware) {
+	es.middleware = append(es.middleware, mw...)
+}
+
+// UseFor adds middleware for one event type. It runs inside the middleware
+// added with Use.
+func (es *EventServiceImpl[T, S]) UseFor(eventType string, mw ...EventMiddleware) {
+	if es.typeMiddleware == nil {
+		es.typeMiddleware = make(map[string][]EventMiddleware)
+	}
+	es.typeMiddleware[eventType] = append(es.typeMiddleware[eventType], mw...)
+}
+
+func (es *EventServiceImpl[T, S]) wrapHandler(eventType string, handler EventHandler) EventHandler {
+	handler = CreateEventMiddleware(es.typeMiddleware[eventType]...)(handler)
+	if es.dedup != nil {
+		handler = idempotent(es.dedup, es.duplicateSkipped)(handler)
+	}
+	return CreateEventMiddleware(es.middleware...)(handler)
+}
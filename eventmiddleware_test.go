@@ -0,0 +1,123 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func recordingMiddleware(name string, calls *[]string) common.EventMiddleware {
+	return func(next common.EventHandler) common.EventHandler {
+		return func(ctx context.Context, event common.Event) error {
+			*calls = append(*calls, name)
+			return next(ctx, event)
+		}
+	}
+}
+
+func TestEventMiddlewareOrder(t *testing.T) {
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), &tenantTransport{}, "test")
+
+	calls := []string{}
+	tenant := ""
+
+	es.SetHandlers(common.EventHandlers{
+		"testPing": func(ctx context.Context, event common.Event) error {
+			calls = append(calls, "handler")
+			tenant = common.TenantFromContext(ctx)
+			return nil
+		},
+	})
+
+	es.Use(recordingMiddleware("global1", &calls), recordingMiddleware("global2", &calls))
+	es.UseFor("testPing", recordingMiddleware("ping", &calls))
+	es.UseFor("testOther", recordingMiddleware("other", &calls))
+
+	err := es.HandleEvent(context.Background(), common.Event{EventType: "testPing", TenantId: "acme"})
+	if err != nil {
+		t.Fatalf("Error handling event: %v", err)
+	}
+
+	want := []string{"global1", "global2", "ping", "handler"}
+	if len(calls) != len(want) {
+		t.Fatalf("Middleware calls are not correct: %v", calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("Middleware calls are not correct: %v", calls)
+		}
+	}
+
+	if tenant != "acme" {
+		t.Errorf("Handler context does not carry the tenant: %s", tenant)
+	}
+}
+
+func TestEventRecover(t *testing.T) {
+	h := common.EventRecover(func(ctx context.Context, event common.Event) error {
+		panic("boom")
+	})
+
+	if err := h(context.Background(), common.Event{}); err == nil {
+		t.Errorf("Panic should be returned as an error")
+	}
+}
+
+func TestEventTimeout(t *testing.T) {
+	h := common.EventTimeout(10 * time.Millisecond)(func(ctx context.Context, event common.Event) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	if err := h(context.Background(), common.Event{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Handler should time out: %v", err)
+	}
+}
+
+func TestEventRetryAndMetrics(t *testing.T) {
+	metrics := common.NewEventMetrics()
+	calls := 0
+
+	h := common.CreateEventMiddleware(
+		metrics.Middleware,
+		common.EventRetry(common.RetryPolicy{MaxAttempts: 3}),
+	)(func(ctx context.Context, event common.Event) error {
+		calls++
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	if err := h(context.Background(), common.Event{EventType: "testPing"}); err != nil {
+		t.Errorf("Handler should succeed on the last attempt: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("Handler was not retried: %d", calls)
+	}
+
+	m := metrics.Snapshot()["testPing"]
+	if m.Handled != 1 || m.Failed != 0 {
+		t.Errorf("Metrics are not correct: %+v", m)
+	}
+}
+
+func TestEventIdempotency(t *testing.T) {
+	calls := 0
+
+	h := common.EventIdempotency(common.NewLRUDedupStore(10))(func(ctx context.Context, event common.Event) error {
+		calls++
+		return nil
+	})
+
+	h(context.Background(), common.Event{EventId: "1"})
+	h(context.Background(), common.Event{EventId: "1"})
+
+	if calls != 1 {
+		t.Errorf("Duplicate event was handled: %d", calls)
+	}
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// eventPool runs tasks on a fixed set of workers. Tasks are partitioned by
+// key, so tasks with the same key always run on the same worker, in the order
+// they were submitted.
+type eventPool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func newEventPool(workers, queueSize int) *eventPool {
+	p := &eventPool{queues: make([]chan func(), workers)}
+	for i := range p.queues {
+		queue := make(chan func(), queueSize)
+		p.queues[i] = queue
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues task on the key's worker, blocking while its queue is full.
+// It returns ctx's error if ctx is done first.
+func (p *eventPool) submit(ctx context.Context, key string, task func()) error {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	select {
+	case queue <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close waits for the workers to finish every queued task.
+func (p *eventPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// partitionKey is the key events are ordered by: the aggregate they belong
+// to, or the event itself when it has none. Events from producers that do
+// not set AggregateId are ordered by the id of the entity in their data, so
+// the Created, Updated and Deleted events of an entity stay in order.
+func partitionKey(event Event) string {
+	if event.AggregateId != "" {
+		return event.AggregateType + ":" + event.AggregateId
+	}
+
+	var entity struct {
+		ID any `json:"id"`
+	}
+	dec := json.NewDecoder(strings.NewReader(event.EventData))
+	dec.UseNumber()
+	if err := dec.Decode(&entity); err == nil && entity.ID != nil {
+		return entityType(event.EventType) + ":" + fmt.Sprint(entity.ID)
+	}
+	return event.EventId
+}
+
+// entityType returns the prefix of an event type published by an event
+// service, such as "task" for "taskCreated".
+func entityType(eventType string) string {
+	for _, suffix := range []string{Created, Updated, Deleted} {
+		if prefix, ok := strings.CutSuffix(eventType, suffix); ok {
+			return prefix
+		}
+	}
+	return eventType
+}
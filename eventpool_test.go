@@ -0,0 +1,122 @@
+package common_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestEventRunnerConcurrency(t *testing.T) {
+	trans := newChanTransport()
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	var inFlight, maxInFlight atomic.Int32
+
+	es.SetHandlers(common.EventHandlers{
+		"testPing": func(ctx context.Context, event common.Event) error {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+
+			time.Sleep(2 * time.Millisecond)
+
+			seq, _ := strconv.Atoi(event.EventData)
+			mu.Lock()
+			seen[event.AggregateId] = append(seen[event.AggregateId], seq)
+			mu.Unlock()
+			return nil
+		},
+	})
+
+	checkpoints := common.NewInMemoryCheckpointStore()
+	es.SetCheckpointStore(checkpoints, "test", 100)
+	es.SetConcurrency(4, 2)
+
+	runner := es.StartEventRunner(context.Background())
+
+	aggregates := []string{"a", "b", "c", "d"}
+	lastId := ""
+	for i := 0; i < 10; i++ {
+		for _, id := range aggregates {
+			lastId = common.NewEventId()
+			trans.PostEvent(common.Event{EventId: lastId, EventType: "testPing", AggregateId: id, EventData: strconv.Itoa(i)})
+		}
+	}
+
+	waitFor(t, "all events to be read", func() bool { return len(trans.events) == 0 })
+
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Error stopping runner: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, id := range aggregates {
+		if len(seen[id]) != 10 {
+			t.Fatalf("Queued events were not drained for %s: %v", id, seen[id])
+		}
+		for i, seq := range seen[id] {
+			if seq != i {
+				t.Errorf("Events for %s were handled out of order: %v", id, seen[id])
+				break
+			}
+		}
+	}
+
+	if maxInFlight.Load() < 2 {
+		t.Errorf("Events were not handled concurrently")
+	}
+
+	saved, _ := checkpoints.Load(context.Background(), "test")
+	if saved != lastId {
+		t.Errorf("Checkpoint is not the last event: %s != %s", saved, lastId)
+	}
+}
+
+func TestEventRunnerConcurrencyLegacyEvents(t *testing.T) {
+	trans := newChanTransport()
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, trans, "test")
+	es.SetConcurrency(4, 2)
+
+	var failed atomic.Int32
+	es.SetErrorHandler(func(err error, event *common.Event) {
+		failed.Add(1)
+	})
+
+	runner := es.StartEventRunner(context.Background())
+
+	// Events from producers that do not set aggregate ids.
+	for i := 0; i < 20; i++ {
+		data := `{"id":"` + strconv.Itoa(i) + `","version":1}`
+		for _, eventType := range []string{"testCreated", "testUpdated", "testDeleted"} {
+			trans.PostEvent(common.Event{EventId: common.NewEventId(), EventType: eventType, EventData: data})
+		}
+	}
+
+	waitFor(t, "all events to be read", func() bool { return len(trans.events) == 0 })
+
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Error stopping runner: %v", err)
+	}
+
+	if failed.Load() != 0 {
+		t.Errorf("Events for the same entity were handled out of order: %d failed", failed.Load())
+	}
+	if all, _ := repo.GetAll(context.Background()); len(all) != 0 {
+		t.Errorf("Deleted entities remain: %d", len(all))
+	}
+}
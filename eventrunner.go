@@ -0,0 +1,446 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type RunnerStatus int32
+
+const (
+	StatusStopped RunnerStatus = iota
+	StatusConnecting
+	StatusRunning
+	// StatusDegraded means the runner is retrying a lost connection or the
+	// last event it received could not be handled.
+	StatusDegraded
+)
+
+func (s RunnerStatus) String() string {
+	switch s {
+	case StatusConnecting:
+		return "connecting"
+	case StatusRunning:
+		return "running"
+	case StatusDegraded:
+		return "degraded"
+	default:
+		return "stopped"
+	}
+}
+
+// EventErrorHandler receives errors from the event runner. event is nil when
+// the error is not about a particular event, such as a lost connection or an
+// event that could not be decoded.
+type EventErrorHandler func(err error, event *Event)
+
+const maxReconnectBackoff = 30 * time.Second
+
+func (es *EventServiceImpl[T, S]) SetErrorHandler(handler EventErrorHandler) {
+	es.errorHandler = handler
+}
+
+func (es *EventServiceImpl[T, S]) SetReconnectBackoff(backoff func(attempt int) time.Duration) {
+	es.reconnectBackoff = backoff
+}
+
+// SetConcurrency makes the event runner handle events on workers goroutines.
+// Events for the same aggregate always go to the same worker, so they are
+// handled in the order they were received. Each worker queues up to
+// queueSize events and the runner stops reading from the transport while the
+// queue it needs is full. When the runner's context is cancelled, queued
+// events are handled before it stops.
+func (es *EventServiceImpl[T, S]) SetConcurrency(workers, queueSize int) {
+	es.workers = max(workers, 1)
+	es.queueSize = max(queueSize, 0)
+}
+
+func (es *EventServiceImpl[T, S]) Status() RunnerStatus {
+	return RunnerStatus(es.status.Load())
+}
+
+func (es *EventServiceImpl[T, S]) setStatus(status RunnerStatus) {
+	es.status.Store(int32(status))
+}
+
+func (es *EventServiceImpl[T, S]) reportError(err error, event *Event) {
+	if es.errorHandler != nil {
+		es.errorHandler(err, event)
+		return
+	}
+	if event != nil {
+		slog.Error("Error handling event", "error", err, "EventId", event.EventId, "EventType", event.EventType)
+		return
+	}
+	slog.Error("Event runner error", "error", err)
+}
+
+func (es *EventServiceImpl[T, S]) backoff(attempt int) time.Duration {
+	if es.reconnectBackoff != nil {
+		return es.reconnectBackoff(attempt)
+	}
+	return min(backoff(attempt), maxReconnectBackoff)
+}
+
+// EventRunner is the handle returned by StartEventRunner.
+type EventRunner struct {
+	cancel         context.CancelFunc
+	cancelHandlers context.CancelFunc
+	transport      Transport
+	done           chan struct{}
+	err            error
+}
+
+// Stop stops reading events and waits for the events already read to be
+// handled. Transports that implement io.Closer are closed, so a blocked read
+// returns straight away. If ctx is done first, in-flight handlers are
+// cancelled and Stop returns ctx's error; events they abandon are not
+// checkpointed, so they are read again on restart. Otherwise Stop returns the
+// runner's final error.
+func (r *EventRunner) Stop(ctx context.Context) error {
+	r.cancel()
+
+	var closeErr error
+	if c, ok := r.transport.(io.Closer); ok {
+		closeErr = c.Close()
+	}
+
+	select {
+	case <-r.done:
+		return errors.Join(closeErr, r.err)
+	case <-ctx.Done():
+		r.cancelHandlers()
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the runner has stopped and returns its final error, such
+// as a checkpoint that could not be saved.
+func (r *EventRunner) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// StartEventRunner connects to the transport and handles events until ctx is
+// cancelled or the runner is stopped. Connection failures are retried with
+// backoff and events that fail are passed to the error handler, so the runner
+// keeps going. It only stops by itself when a failed event cannot be added to
+// the dead letter store; Wait then returns an ErrDeadLetterFailed error.
+func (es *EventServiceImpl[T, S]) StartEventRunner(ctx context.Context) *EventRunner {
+	es.setStatus(StatusConnecting)
+
+	readCtx, cancel := context.WithCancel(ctx)
+	// Handlers outlive ctx so that events already read can finish.
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+
+	r := &EventRunner{
+		cancel:         cancel,
+		cancelHandlers: cancelHandlers,
+		transport:      es.Transport,
+		done:           make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+		defer cancelHandlers()
+		defer cancel()
+		r.err = es.runEvents(readCtx, handlerCtx)
+	}()
+
+	return r
+}
+
+func (es *EventServiceImpl[T, S]) runEvents(ctx context.Context, handlerCtx context.Context) (err error) {
+	defer es.setStatus(StatusStopped)
+
+	es.resumeFromCheckpoint(ctx)
+
+	var cp *checkpointer
+	if es.checkpoints != nil {
+		cp = newCheckpointer(es.saveCheckpoint, es.checkpointEvery)
+	}
+
+	// An event that can be neither handled nor dead lettered stops the
+	// runner, so the checkpoint stays before it and it is read again on
+	// restart.
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var failOnce sync.Once
+	var failed error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failed = err
+			stop()
+			if c, ok := es.Transport.(io.Closer); ok {
+				c.Close()
+			}
+		})
+	}
+
+	defer func() {
+		err = errors.Join(failed, cp.flush())
+	}()
+
+	dispatch := func(ev Event) error {
+		if err := es.processEvent(handlerCtx, ev, cp, cp.started(es.cursor(ev))); err != nil {
+			fail(err)
+		}
+		return nil
+	}
+
+	if es.workers > 1 {
+		pool := newEventPool(es.workers, es.queueSize)
+		defer pool.close()
+
+		dispatch = func(ev Event) error {
+			seq := cp.started(es.cursor(ev))
+			return pool.submit(ctx, partitionKey(ev), func() {
+				if err := es.processEvent(handlerCtx, ev, cp, seq); err != nil {
+					fail(err)
+				}
+			})
+		}
+	}
+
+	attempt := 0
+	for ctx.Err() == nil {
+		if attempt == 0 {
+			es.setStatus(StatusConnecting)
+		}
+
+		err := es.Connect(ctx)
+		if err == nil {
+			es.setStatus(StatusRunning)
+			attempt = 0
+			err = es.consumeEvents(ctx, dispatch)
+			if err == nil {
+				return nil
+			}
+		}
+
+		// Reads fail when the runner is stopped, which is not an error.
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		es.reportError(fmt.Errorf("event stream: %w", err), nil)
+		es.setStatus(StatusDegraded)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(es.backoff(attempt)):
+		}
+		attempt++
+	}
+	return nil
+}
+
+// consumeEvents passes events to dispatch until ctx is done, when it returns
+// nil, or the transport fails, when it returns the transport's error.
+func (es *EventServiceImpl[T, S]) consumeEvents(ctx context.Context, dispatch func(Event) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		ev, err := es.NextEvent()
+
+		var decodeErr *EventDecodeError
+		if errors.As(err, &decodeErr) {
+			es.reportError(err, nil)
+			es.setStatus(StatusDegraded)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ev == nil {
+			continue
+		}
+
+		if err := dispatch(*ev); err != nil {
+			return nil
+		}
+	}
+}
+
+// processEvent handles ev and marks it finished. It returns an error only
+// when the runner must stop because a failed event could not be dead
+// lettered.
+func (es *EventServiceImpl[T, S]) processEvent(ctx context.Context, ev Event, cp *checkpointer, seq uint64) error {
+	parked, err := es.handleWithRetry(ctx, ev)
+
+	// The runner was stopped before the handler finished. The event is left
+	// unfinished so the checkpoint does not move past it.
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+
+	es.eventHandled(ev, err)
+
+	if err != nil {
+		es.reportError(err, &ev)
+		es.setStatus(StatusDegraded)
+	} else {
+		es.setStatus(StatusRunning)
+	}
+
+	// An event that could not be dead lettered is left unfinished too, and
+	// the runner stops, so it is read again on restart rather than lost.
+	if errors.Is(err, ErrDeadLetterFailed) {
+		return fmt.Errorf("stopping event runner: %w", err)
+	}
+
+	// Dead lettered events are parked, so the checkpoint moves on.
+	cp.finished(ctx, seq, err == nil || parked)
+	return nil
+}
+
+// cursor returns the position to checkpoint for an event just read. Streams
+// that resume from their own ids, such as server-sent events, report the id
+// sent with the event from StreamId. Events without one, and events from
+// other transports, are checkpointed by event id.
+func (es *EventServiceImpl[T, S]) cursor(ev Event) string {
+	if t, ok := es.Transport.(interface{ StreamId() string }); ok {
+		if id := t.StreamId(); id != "" {
+			return id
+		}
+	}
+	return ev.EventId
+}
+
+func (es *EventServiceImpl[T, S]) resumeFromCheckpoint(ctx context.Context) {
+	if es.checkpoints == nil {
+		return
+	}
+
+	t, ok := es.Transport.(interface{ SetLastEventId(id string) })
+	if !ok {
+		return
+	}
+
+	lastId, err := es.checkpoints.Load(ctx, es.checkpointName)
+	if err != nil {
+		slog.Error("Error loading checkpoint", "name", es.checkpointName, "error", err)
+		return
+	}
+
+	if lastId != "" {
+		slog.Info("Resuming from checkpoint", "name", es.checkpointName, "lastEventId", lastId)
+		t.SetLastEventId(lastId)
+	}
+}
+
+func (es *EventServiceImpl[T, S]) saveCheckpoint(ctx context.Context, eventId string) error {
+	err := es.checkpoints.Save(ctx, es.checkpointName, eventId)
+	if err != nil {
+		slog.Error("Error saving checkpoint", "name", es.checkpointName, "error", err)
+		return fmt.Errorf("saving checkpoint %s: %w", es.checkpointName, err)
+	}
+	return nil
+}
+
+// checkpointer saves every nth handled event id and the last one on flush.
+// Events may finish out of order when the runner is concurrent, so it only
+// moves past an event once every event received before it has finished. A nil
+// checkpointer does nothing.
+type checkpointer struct {
+	mu      sync.Mutex
+	save    func(ctx context.Context, eventId string) error
+	every   int
+	issued  uint64
+	next    uint64
+	ids     map[uint64]string
+	done    map[uint64]bool
+	lastId  string
+	pending int
+	err     error
+}
+
+func newCheckpointer(save func(ctx context.Context, eventId string) error, every int) *checkpointer {
+	return &checkpointer{
+		save:  save,
+		every: every,
+		ids:   make(map[uint64]string),
+		done:  make(map[uint64]bool),
+	}
+}
+
+// started records an event in the order it was received and returns its
+// sequence number.
+func (cp *checkpointer) started(eventId string) uint64 {
+	if cp == nil {
+		return 0
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	seq := cp.issued
+	cp.issued++
+	cp.ids[seq] = eventId
+	return seq
+}
+
+// finished marks an event as finished. Events that are not handled are not
+// checkpointed themselves, but no longer hold back the events after them.
+func (cp *checkpointer) finished(ctx context.Context, seq uint64, handled bool) {
+	if cp == nil {
+		return
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.done[seq] = true
+	if !handled {
+		cp.ids[seq] = ""
+	}
+
+	for cp.done[cp.next] {
+		if id := cp.ids[cp.next]; id != "" {
+			cp.lastId = id
+			cp.pending++
+		}
+		delete(cp.done, cp.next)
+		delete(cp.ids, cp.next)
+		cp.next++
+	}
+
+	if cp.pending >= cp.every {
+		if err := cp.save(ctx, cp.lastId); err != nil && cp.err == nil {
+			cp.err = err
+		}
+		cp.pending = 0
+	}
+}
+
+// flush saves the last handled event id and returns the first error from
+// saving a checkpoint, whether now or while the runner was going.
+func (cp *checkpointer) flush() error {
+	if cp == nil {
+		return nil
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.pending == 0 {
+		return cp.err
+	}
+
+	cp.pending = 0
+	if err := cp.save(context.Background(), cp.lastId); err != nil && cp.err == nil {
+		cp.err = err
+	}
+	return cp.err
+}
@@ -0,0 +1,293 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEventRunnerPoisonEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {not json\n\n"))
+		w.Write([]byte(sseEvent("testCreated", "A")))
+	}))
+	defer server.Close()
+
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, common.NewHttpTransport("", server.URL, 1), "test")
+	es.SetReconnectBackoff(func(attempt int) time.Duration {
+		return 10 * time.Millisecond
+	})
+
+	checkpoints := common.NewInMemoryCheckpointStore()
+	es.SetCheckpointStore(checkpoints, "runner", 1)
+
+	var mu sync.Mutex
+	var errs []error
+	es.SetErrorHandler(func(err error, event *common.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	es.StartEventRunner(ctx)
+
+	waitFor(t, "poison event to be reported", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	})
+
+	mu.Lock()
+	var decodeErr *common.EventDecodeError
+	if !errors.As(errs[0], &decodeErr) {
+		t.Errorf("Error is not a decode error: %v", errs[0])
+	}
+	mu.Unlock()
+
+	waitFor(t, "event after the poison event to be handled", func() bool {
+		id, _ := checkpoints.Load(context.Background(), "runner")
+		return id == "A"
+	})
+
+	cancel()
+
+	waitFor(t, "runner to stop", func() bool {
+		return es.Status() == common.StatusStopped
+	})
+}
+
+func TestEventRunnerReconnect(t *testing.T) {
+	var connections atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if connections.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(sseEvent("testCreated", "A")))
+	}))
+	defer server.Close()
+
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, common.NewHttpTransport("", server.URL, 0), "test")
+	es.SetReconnectBackoff(func(attempt int) time.Duration {
+		return time.Millisecond
+	})
+	es.SetErrorHandler(func(err error, event *common.Event) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	es.StartEventRunner(ctx)
+
+	waitFor(t, "runner to reconnect", func() bool {
+		return connections.Load() >= 3
+	})
+}
+
+func TestHttpTransportConnectError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	ht := common.NewHttpTransport("", server.URL, 0)
+
+	if err := ht.Connect(context.Background()); err == nil {
+		t.Errorf("Connect should return an error")
+	}
+
+	if _, err := ht.NextEvent(); err == nil {
+		t.Errorf("NextEvent should return an error when not connected")
+	}
+}
+
+func TestEventRunnerStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(sseEvent("testCreated", "A")))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), common.NewHttpTransport("", server.URL, 0), "test")
+
+	checkpoints := common.NewInMemoryCheckpointStore()
+	es.SetCheckpointStore(checkpoints, "test", 100)
+
+	runner := es.StartEventRunner(context.Background())
+
+	waitFor(t, "event to be handled", func() bool {
+		ok, _ := es.Exists(context.Background(), "A")
+		return ok
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := runner.Stop(ctx); err != nil {
+		t.Fatalf("Error stopping runner: %v", err)
+	}
+
+	if es.Status() != common.StatusStopped {
+		t.Errorf("Runner status is not stopped: %s", es.Status())
+	}
+
+	lastId, _ := checkpoints.Load(context.Background(), "test")
+	if lastId != "A" {
+		t.Errorf("Checkpoint was not flushed on stop: %s", lastId)
+	}
+}
+
+func TestEventRunnerStopDeadline(t *testing.T) {
+	trans := newChanTransport()
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+
+	started := make(chan struct{})
+	es.SetHandlers(common.EventHandlers{
+		"testSlow": func(ctx context.Context, event common.Event) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	es.SetErrorHandler(func(err error, event *common.Event) {})
+
+	checkpoints := common.NewInMemoryCheckpointStore()
+	es.SetCheckpointStore(checkpoints, "test", 1)
+
+	runner := es.StartEventRunner(context.Background())
+	trans.PostEvent(common.Event{EventId: "1", EventType: "testSlow"})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := runner.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop should return the deadline error: %v", err)
+	}
+
+	runner.Wait()
+
+	lastId, _ := checkpoints.Load(context.Background(), "test")
+	if lastId != "" {
+		t.Errorf("Abandoned event should not be checkpointed: %s", lastId)
+	}
+}
+
+func TestEventRunnerConnectionRefused(t *testing.T) {
+	// Nothing listens on the port, so every connection is refused.
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), common.NewHttpTransport("", url, 1), "test")
+	es.SetReconnectBackoff(func(attempt int) time.Duration {
+		return time.Millisecond
+	})
+
+	var reported atomic.Int32
+	es.SetErrorHandler(func(err error, event *common.Event) {
+		reported.Add(1)
+	})
+
+	runner := es.StartEventRunner(context.Background())
+
+	waitFor(t, "refused connection to be reported", func() bool {
+		return reported.Load() > 0
+	})
+
+	if status := es.Status(); status != common.StatusDegraded && status != common.StatusConnecting {
+		t.Errorf("Runner should keep retrying: %s", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := runner.Stop(ctx); err != nil {
+		t.Errorf("Error stopping runner: %v", err)
+	}
+}
+
+func TestEventRunnerStopWhileRetrying(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// The client backs off for 1, 2, 4... seconds between retries.
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), common.NewHttpTransport("", server.URL, 5), "test")
+	es.SetErrorHandler(func(err error, event *common.Event) {})
+
+	runner := es.StartEventRunner(context.Background())
+
+	waitFor(t, "first connection", func() bool {
+		return connections.Load() > 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if err := runner.Stop(ctx); err != nil {
+		t.Errorf("Stop should not wait for the retry backoff: %v", err)
+	}
+}
+
+type failingCheckpointStore struct {
+	*common.InMemoryCheckpointStore
+	saves atomic.Int32
+}
+
+func (s *failingCheckpointStore) Save(ctx context.Context, name string, eventId string) error {
+	if s.saves.Add(1) == 1 {
+		return errors.New("store unavailable")
+	}
+	return s.InMemoryCheckpointStore.Save(ctx, name, eventId)
+}
+
+func TestEventRunnerReportsCheckpointFailures(t *testing.T) {
+	trans := newChanTransport()
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+
+	checkpoints := &failingCheckpointStore{InMemoryCheckpointStore: common.NewInMemoryCheckpointStore()}
+	es.SetCheckpointStore(checkpoints, "test", 1)
+
+	runner := es.StartEventRunner(context.Background())
+
+	trans.PostEvent(common.Event{EventId: "1", EventType: "testPing"})
+	waitFor(t, "checkpoint to be saved", func() bool { return checkpoints.saves.Load() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := runner.Stop(ctx); err == nil {
+		t.Errorf("Periodic checkpoint failure should be returned when the runner stops")
+	}
+}
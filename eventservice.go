@@ -2,9 +2,9 @@ package common
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"fmt"
 	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,15 +16,29 @@ const (
 )
 
 type Event struct {
-	EventId      string    `json:"eventId"`
-	EventSHA     string    `json:"eventSHA"`
-	EventType    string    `json:"eventType"`
-	EventData    string    `json:"eventData"`
-	EventVersion int       `json:"eventVersion"`
-	EventTime    time.Time `json:"eventTime"`
+	EventId       string    `json:"eventId"`
+	EventSHA      string    `json:"eventSHA"`
+	EventType     string    `json:"eventType"`
+	EventData     string    `json:"eventData"`
+	EventVersion  int       `json:"eventVersion"`
+	EventTime     time.Time `json:"eventTime"`
+	TenantId      string    `json:"tenantId,omitempty"`
+	SchemaVersion int       `json:"schemaVersion,omitempty"`
+
+	AggregateId       string            `json:"aggregateId,omitempty"`
+	AggregateType     string            `json:"aggregateType,omitempty"`
+	AggregateSequence int               `json:"aggregateSequence,omitempty"`
+	CorrelationId     string            `json:"correlationId,omitempty"`
+	CausationId       string            `json:"causationId,omitempty"`
+	Actor             string            `json:"actor,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+
+	Signature      string `json:"signature,omitempty"`
+	SignatureKeyId string `json:"signatureKeyId,omitempty"`
+	SignatureAlg   string `json:"signatureAlg,omitempty"`
 }
 
-type EventHandler func(event Event) error
+type EventHandler func(ctx context.Context, event Event) error
 
 type EventHandlers map[string]EventHandler
 
@@ -33,13 +47,18 @@ type Transport interface {
 	PostEvent(Event) error
 	NextEvent() (*Event, error)
 }
+
+// EventService is a repository whose changes are published as events and
+// applied when they come back from the transport. Everything else about how
+// events are handled is configured on the *EventServiceImpl that
+// NewEventService returns.
 type EventService[T Entity[S], S comparable] interface {
 	Repository[T, S]
 	Transport
 	SetPrefix(prefix string)
 	SetHandlers(handlers EventHandlers)
-	HandleEvent(event Event) error
-	StartEventRunner(ctx context.Context)
+	HandleEvent(ctx context.Context, event Event) error
+	StartEventRunner(ctx context.Context) *EventRunner
 }
 
 type EventServiceImpl[T Entity[S], S comparable] struct {
@@ -47,6 +66,39 @@ type EventServiceImpl[T Entity[S], S comparable] struct {
 	Transport
 	Prefix   string
 	Handlers EventHandlers
+	schemas  *SchemaRegistry
+	verifier *EventVerifier
+	dedup    DedupStore
+	skipped  atomic.Uint64
+
+	checkpoints     CheckpointStore
+	checkpointName  string
+	checkpointEvery int
+
+	errorHandler     EventErrorHandler
+	reconnectBackoff func(attempt int) time.Duration
+	status           atomic.Int32
+
+	workers   int
+	queueSize int
+
+	retryPolicy RetryPolicy
+	deadLetters DeadLetterStore
+
+	middleware     []EventMiddleware
+	typeMiddleware map[string][]EventMiddleware
+
+	codec Codec
+
+	subscriptions []subscription
+	fallback      EventHandler
+
+	consistency  ConsistencyMode
+	awaitTimeout time.Duration
+	echoes       *LRUDedupStore
+	awaiting     *awaiters
+
+	outbox *Outbox
 }
 
 func (es *EventServiceImpl[T, S]) SetPrefix(prefix string) {
@@ -57,25 +109,94 @@ func (es *EventServiceImpl[T, S]) SetHandlers(handlers EventHandlers) {
 	es.Handlers = handlers
 }
 
-func (es *EventServiceImpl[T, S]) Create(ctx context.Context, e T) error {
-	slog.Info("EventService", "Create", e)
-	ent, err := json.Marshal(e)
+// SetEventCodec sets the codec used for event payloads. It must produce text,
+// since payloads travel as strings. The default is JSON.
+func (es *EventServiceImpl[T, S]) SetEventCodec(codec Codec) {
+	es.codec = codec
+}
+
+func (es *EventServiceImpl[T, S]) EventCodec() Codec {
+	if es.codec == nil {
+		return JSONCodec{}
+	}
+	return es.codec
+}
+
+func (es *EventServiceImpl[T, S]) SetSchemaRegistry(schemas *SchemaRegistry) {
+	es.schemas = schemas
+}
+
+func (es *EventServiceImpl[T, S]) SetVerifier(verifier *EventVerifier) {
+	es.verifier = verifier
+}
 
+// SetDedupStore makes HandleEvent skip events whose id is already in store.
+// Ids are recorded once their handler succeeds.
+func (es *EventServiceImpl[T, S]) SetDedupStore(store DedupStore) {
+	es.dedup = store
+}
+
+// SetCheckpointStore makes the event runner resume from the checkpoint saved
+// under name and save the id of the last handled event every n events.
+func (es *EventServiceImpl[T, S]) SetCheckpointStore(store CheckpointStore, name string, every int) {
+	es.checkpoints = store
+	es.checkpointName = name
+	es.checkpointEvery = max(every, 1)
+}
+
+func (es *EventServiceImpl[T, S]) DuplicatesSkipped() uint64 {
+	return es.skipped.Load()
+}
+
+func (es *EventServiceImpl[T, S]) schemaVersion() int {
+	if es.schemas == nil {
+		return 0
+	}
+	return es.schemas.CurrentVersion(es.Prefix)
+}
+
+func (es *EventServiceImpl[T, S]) newEvent(ctx context.Context, eventType string, e T) (Event, error) {
+	ent, err := es.EventCodec().Marshal(e)
 	if err != nil {
-		return err
+		return Event{}, err
 	}
 
+	id := NewEventId()
+
+	correlationId := CorrelationIdFromContext(ctx)
+	if correlationId == "" {
+		correlationId = id
+	}
+
+	return Event{
+		EventId:           id,
+		EventType:         es.Prefix + eventType,
+		EventTime:         time.Now(),
+		EventVersion:      Version,
+		EventData:         string(ent),
+		TenantId:          TenantFromContext(ctx),
+		SchemaVersion:     es.schemaVersion(),
+		AggregateId:       fmt.Sprint(e.GetID()),
+		AggregateType:     es.Prefix,
+		AggregateSequence: e.GetVersion(),
+		CorrelationId:     correlationId,
+		CausationId:       CausationIdFromContext(ctx),
+		Actor:             actorFromContext(ctx),
+		Metadata:          EventMetadataFromContext(ctx),
+	}, nil
+}
+
+func (es *EventServiceImpl[T, S]) Create(ctx context.Context, e T) error {
+	slog.Info("EventService", "Create", e)
+
 	// Broadcast event
-	event := Event{
-		EventId:      "1",
-		EventType:    es.Prefix + Created,
-		EventTime:    time.Now(),
-		EventVersion: Version,
-		EventData:    string(ent),
+	event, err := es.newEvent(ctx, Created, e)
+	if err != nil {
+		return err
 	}
 
 	slog.Info("EventBroadcaster", "Create", event.EventData)
-	err = es.PostEvent(event)
+	err = es.publish(ctx, event, e)
 
 	if err != nil {
 		slog.Error("Error broadcasting event", "error", err)
@@ -91,23 +212,15 @@ func (es *EventServiceImpl[T, S]) Create(ctx context.Context, e T) error {
 func (es *EventServiceImpl[T, S]) Save(ctx context.Context, e T) error {
 	slog.Info("EventService", "Save", e)
 
-	ent, err := json.Marshal(e)
-
+	// Broadcast event
+	event, err := es.newEvent(ctx, Updated, e)
 	if err != nil {
 		slog.Error("Error marshalling event", "error", err)
-	}
-
-	// Broadcast event
-	event := Event{
-		EventId:      "1",
-		EventType:    es.Prefix + Updated,
-		EventTime:    time.Now(),
-		EventVersion: Version,
-		EventData:    string(ent),
+		return err
 	}
 
 	slog.Info("EventBroadcaster", "Save", event.EventData)
-	err = es.PostEvent(event)
+	err = es.publish(ctx, event, e)
 
 	if err != nil {
 		slog.Error("Error broadcasting event", "error", err)
@@ -122,24 +235,15 @@ func (es *EventServiceImpl[T, S]) Save(ctx context.Context, e T) error {
 func (es *EventServiceImpl[T, S]) Delete(ctx context.Context, e T) error {
 	slog.Info("EventService", "Delete", e)
 
-	ent, err := json.Marshal(e)
-
+	// Broadcast event
+	event, err := es.newEvent(ctx, Deleted, e)
 	if err != nil {
 		slog.Error("Error marshalling event", "error", err)
-	}
-
-	// Broadcast event
-
-	event := Event{
-		EventId:      "1",
-		EventType:    es.Prefix + Deleted,
-		EventTime:    time.Now(),
-		EventVersion: Version,
-		EventData:    string(ent),
+		return err
 	}
 
 	slog.Info("EventBroadcaster", "Delete", event.EventData)
-	err = es.PostEvent(event)
+	err = es.publish(ctx, event, e)
 
 	if err != nil {
 		slog.Error("Error broadcasting event", "error", err)
@@ -168,52 +272,59 @@ func (es *EventServiceImpl[T, S]) GetAll(ctx context.Context) ([]T, error) {
 	return es.Repository.GetAll(ctx)
 }
 
-func (es *EventServiceImpl[T, S]) decodeEntity(data string) T {
+func (es *EventServiceImpl[T, S]) decodeEntity(event Event) (T, error) {
 
 	var e T
-	err := json.Unmarshal([]byte(data), &e)
+
+	data := []byte(event.EventData)
+	if es.schemas != nil {
+		var err error
+		data, err = es.schemas.Upcast(es.Prefix, event.SchemaVersion, es.EventCodec(), data)
+		if err != nil {
+			return e, err
+		}
+	}
+
+	err := es.EventCodec().Unmarshal(data, &e)
 	if err != nil {
-		log.Fatal(err)
+		return e, fmt.Errorf("decoding %s event %s: %w", event.EventType, event.EventId, err)
 	}
 
-	return e
+	return e, nil
 }
 
-func (es *EventServiceImpl[T, S]) HandleEvent(event Event) error {
+func (es *EventServiceImpl[T, S]) HandleEvent(ctx context.Context, event Event) error {
 	slog.Info("EventService", "HandleEvent", event, "EventType", event.EventType)
-	handler, ok := es.Handlers[event.EventType]
-	if !ok {
-		return nil
+	if es.verifier != nil {
+		ok, err := es.verifier.check(event)
+		if !ok {
+			return err
+		}
 	}
-	return handler(event)
+	return es.handle(ctx, event)
 }
 
-func (es *EventServiceImpl[T, S]) StartEventRunner(ctx context.Context) {
-	go func() {
+// handle runs the handlers for an event that has been verified.
+func (es *EventServiceImpl[T, S]) handle(ctx context.Context, event Event) error {
+	if es.isEcho(ctx, event) {
+		es.duplicateSkipped(event)
+		return nil
+	}
+	handler := es.dispatcher(event.EventType)
+	if handler == nil {
+		return nil
+	}
+	ctx = withHandlerProgress(ctx)
 
-		err := es.Connect(ctx)
+	return es.wrapHandler(event.EventType, handler)(EventContext(ctx, event), event)
+}
 
-		if err != nil {
-			log.Fatal(err)
-		}
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				ev, err := es.NextEvent()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				if ev != nil {
-					es.HandleEvent(*ev)
-				}
-			}
-		}
-	}()
+func (es *EventServiceImpl[T, S]) duplicateSkipped(event Event) {
+	es.skipped.Add(1)
+	slog.Info("EventService", "Duplicate", event.EventId, "Skipped", es.skipped.Load())
 }
-func NewEventService[T Entity[S], S comparable](repo Repository[T, S], transport Transport, prefix string) EventService[T, S] {
+
+func NewEventService[T Entity[S], S comparable](repo Repository[T, S], transport Transport, prefix string) *EventServiceImpl[T, S] {
 
 	es := EventServiceImpl[T, S]{
 		Repository: repo,
@@ -223,34 +334,40 @@ func NewEventService[T Entity[S], S comparable](repo Repository[T, S], transport
 	}
 	handlers := make(EventHandlers)
 
-	handlers[prefix+Created] = func(event Event) error {
+	handlers[prefix+Created] = func(ctx context.Context, event Event) error {
 
 		slog.Info("EventService", "Create", event.EventData)
 
-		var e T = es.decodeEntity(event.EventData)
+		e, err := es.decodeEntity(event)
+		if err != nil {
+			return err
+		}
 
-		repo.Create(context.Background(), e)
-		return nil
+		return repo.Create(ctx, e)
 	}
 
-	handlers[prefix+Updated] = func(event Event) error {
+	handlers[prefix+Updated] = func(ctx context.Context, event Event) error {
 
 		slog.Info("EventService", "Update", event.EventData)
 
-		var e T = es.decodeEntity(event.EventData)
+		e, err := es.decodeEntity(event)
+		if err != nil {
+			return err
+		}
 
-		repo.Save(context.Background(), e)
-		return nil
+		return repo.Save(ctx, e)
 	}
 
-	handlers[prefix+Deleted] = func(event Event) error {
+	handlers[prefix+Deleted] = func(ctx context.Context, event Event) error {
 
 		slog.Info("EventService", "Delete", event.EventData)
 
-		var e T = es.decodeEntity(event.EventData)
+		e, err := es.decodeEntity(event)
+		if err != nil {
+			return err
+		}
 
-		repo.Delete(context.Background(), e)
-		return nil
+		return repo.Delete(ctx, e)
 	}
 
 	es.SetHandlers(handlers)
@@ -88,7 +88,7 @@ func TestEventServiceCreate(t *testing.T) {
 		t.Errorf("Event version is not correct: %d", nextEvent.EventVersion)
 	}
 
-	if nextEvent.EventId != "1" {
+	if len(nextEvent.EventId) != 26 {
 		t.Errorf("Event id is not correct: %s", nextEvent.EventId)
 	}
 
@@ -100,7 +100,7 @@ func TestEventServiceCreate(t *testing.T) {
 		t.Errorf("NextEvent was not called")
 	}
 
-	err = es.HandleEvent(*nextEvent)
+	err = es.HandleEvent(context.Background(), *nextEvent)
 
 	if err != nil {
 		t.Errorf("Error handling event: %v", err)
@@ -145,7 +145,7 @@ func TestEventServiceDelete(t *testing.T) {
 		t.Errorf("Event version is not correct: %d", nextEvent.EventVersion)
 	}
 
-	if nextEvent.EventId != "1" {
+	if len(nextEvent.EventId) != 26 {
 		t.Errorf("Event id is not correct: %s", nextEvent.EventId)
 	}
 
@@ -157,7 +157,7 @@ func TestEventServiceDelete(t *testing.T) {
 		t.Errorf("NextEvent was not called")
 	}
 
-	err = es.HandleEvent(*nextEvent)
+	err = es.HandleEvent(context.Background(), *nextEvent)
 
 	if err != nil {
 		t.Errorf("Error handling event: %v", err)
@@ -202,7 +202,7 @@ func TestEventServiceSave(t *testing.T) {
 		t.Errorf("Event version is not correct: %d", nextEvent.EventVersion)
 	}
 
-	if nextEvent.EventId != "1" {
+	if len(nextEvent.EventId) != 26 {
 		t.Errorf("Event id is not correct: %s", nextEvent.EventId)
 	}
 
@@ -214,7 +214,7 @@ func TestEventServiceSave(t *testing.T) {
 		t.Errorf("NextEvent was not called")
 	}
 
-	err = es.HandleEvent(*nextEvent)
+	err = es.HandleEvent(context.Background(), *nextEvent)
 
 	if err != nil {
 		t.Errorf("Error handling event: %v", err)
@@ -339,3 +339,23 @@ func TestEventStartEventRunner(t *testing.T) {
 		}
 	}
 }
+
+// stubEventService implements EventService with only the methods a mock
+// needs; configuration lives on EventServiceImpl.
+type stubEventService struct {
+	common.Repository[*common.BaseEntity[string], string]
+	common.Transport
+}
+
+func (stubEventService) SetPrefix(prefix string)                                   {}
+func (stubEventService) SetHandlers(handlers common.EventHandlers)                 {}
+func (stubEventService) HandleEvent(ctx context.Context, event common.Event) error { return nil }
+func (stubEventService) StartEventRunner(ctx context.Context) *common.EventRunner  { return nil }
+
+func TestEventServiceCanBeStubbed(t *testing.T) {
+	var es common.EventService[*common.BaseEntity[string], string] = stubEventService{}
+
+	if err := es.HandleEvent(context.Background(), common.Event{}); err != nil {
+		t.Errorf("Stub should handle events: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Aggregate is an entity whose state is rebuilt by replaying its events.
+type Aggregate[S comparable] interface {
+	Entity[S]
+	// When updates the aggregate's state for event. It is called for new
+	// events and again whenever the aggregate is replayed, so it must not
+	// have side effects, and it must restore the aggregate's id.
+	When(event Event) error
+	Changes() []Event
+	ClearChanges()
+}
+
+// AggregateBase is embedded in aggregates to record their new events.
+type AggregateBase[S comparable] struct {
+	BaseEntity[S]
+	changes []Event
+}
+
+// Apply applies a new event to agg, the aggregate embedding a, and records it
+// to be appended on the next Create or Save. payload is encoded as JSON.
+func (a *AggregateBase[S]) Apply(agg Aggregate[S], eventType string, payload any) error {
+	data, err := JSONCodec{}.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	event := Event{
+		EventType:    eventType,
+		EventData:    string(data),
+		EventVersion: Version,
+		EventTime:    time.Now(),
+	}
+
+	if err := agg.When(event); err != nil {
+		return err
+	}
+
+	a.changes = append(a.changes, event)
+	return nil
+}
+
+func (a *AggregateBase[S]) Changes() []Event {
+	return a.changes
+}
+
+func (a *AggregateBase[S]) ClearChanges() {
+	a.changes = nil
+}
+
+// DecodePayload decodes the payload of an event recorded with Apply.
+func DecodePayload[P any](event Event) (P, error) {
+	var payload P
+	if err := (JSONCodec{}).Unmarshal([]byte(event.EventData), &payload); err != nil {
+		return payload, &EventDecodeError{Data: event.EventData, Err: err}
+	}
+	return payload, nil
+}
+
+// EventSourcedRepository is a Repository whose entities are aggregates
+// replayed from an EventStore. Create and Save append the aggregate's
+// changes, and Delete appends a deleted event, after which the id cannot be
+// reused.
+type EventSourcedRepository[T Aggregate[S], S comparable] struct {
+	store   EventStore
+	prefix  string
+	factory func() T
+
+	snapshots      SnapshotStore
+	snapshotPolicy SnapshotPolicy
+	codec          Codec
+	schemas        *SchemaRegistry
+}
+
+func (r *EventSourcedRepository[T, S]) Create(ctx context.Context, e T) error {
+	if len(e.Changes()) == 0 {
+		return errors.New("aggregate has no events")
+	}
+	return r.append(ctx, e, 0)
+}
+
+// Save appends the aggregate's changes if nothing else has been appended
+// since it was loaded, or returns ErrConcurrencyConflict.
+func (r *EventSourcedRepository[T, S]) Save(ctx context.Context, e T) error {
+	return r.append(ctx, e, e.GetVersion())
+}
+
+func (r *EventSourcedRepository[T, S]) Get(ctx context.Context, id S) (T, error) {
+	e, _, err := r.load(ctx, fmt.Sprint(id))
+	return e, err
+}
+
+func (r *EventSourcedRepository[T, S]) GetAll(ctx context.Context) ([]T, error) {
+	ids, err := r.store.AggregateIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	es := []T{}
+	for _, id := range ids {
+		e, ok, err := r.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			es = append(es, e)
+		}
+	}
+	return es, nil
+}
+
+func (r *EventSourcedRepository[T, S]) Delete(ctx context.Context, e T) error {
+	id := fmt.Sprint(e.GetID())
+
+	_, ok, err := r.load(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("entity not found")
+	}
+
+	deleted := r.stamp(ctx, Event{
+		EventType:    r.prefix + Deleted,
+		EventVersion: Version,
+		EventTime:    time.Now(),
+	}, "")
+	return r.store.Append(ctx, id, AnyVersion, []Event{deleted})
+}
+
+func (r *EventSourcedRepository[T, S]) Exists(ctx context.Context, id S) (bool, error) {
+	_, ok, err := r.load(ctx, fmt.Sprint(id))
+	return ok, err
+}
+
+func (r *EventSourcedRepository[T, S]) GetId(ctx context.Context, e T) (S, error) {
+	return e.GetID(), nil
+}
+
+func (r *EventSourcedRepository[T, S]) append(ctx context.Context, e T, expectedVersion int) error {
+	changes := e.Changes()
+	if len(changes) == 0 {
+		return nil
+	}
+
+	correlationId := CorrelationIdFromContext(ctx)
+
+	events := make([]Event, len(changes))
+	for i, change := range changes {
+		events[i] = r.stamp(ctx, change, correlationId)
+		if correlationId == "" {
+			correlationId = events[i].EventId
+		}
+	}
+
+	err := r.store.Append(ctx, fmt.Sprint(e.GetID()), expectedVersion, events)
+	if err != nil {
+		return err
+	}
+
+	if expectedVersion == 0 {
+		e.SetCreationDate(events[0].EventTime)
+	}
+	e.SetLastUpdateDate(events[len(events)-1].EventTime)
+	e.SetVersion(expectedVersion + len(events))
+	e.ClearChanges()
+
+	r.snapshotIfDue(ctx, e)
+	return nil
+}
+
+// stamp fills in the envelope of an event about to be appended. The first
+// event of a batch correlates the rest when ctx has no correlation id.
+func (r *EventSourcedRepository[T, S]) stamp(ctx context.Context, event Event, correlationId string) Event {
+	event.EventId = NewEventId()
+	event.AggregateType = r.prefix
+	event.TenantId = TenantFromContext(ctx)
+	event.CorrelationId = correlationId
+	if event.CorrelationId == "" {
+		event.CorrelationId = event.EventId
+	}
+	event.CausationId = CausationIdFromContext(ctx)
+	event.Actor = actorFromContext(ctx)
+	event.Metadata = EventMetadataFromContext(ctx)
+	return event
+}
+
+// load replays an aggregate from its latest snapshot, if any. It returns
+// false if the aggregate has no events or has been deleted.
+func (r *EventSourcedRepository[T, S]) load(ctx context.Context, aggregateId string) (T, bool, error) {
+	var zero T
+
+	e := r.factory()
+	version := r.restore(ctx, aggregateId, e)
+
+	events, err := r.store.Load(ctx, aggregateId, version)
+	if err != nil {
+		return zero, false, err
+	}
+	if len(events) == 0 {
+		if version == 0 {
+			return zero, false, nil
+		}
+		return e, true, nil
+	}
+
+	last := events[len(events)-1]
+	if last.EventType == r.prefix+Deleted {
+		return zero, false, nil
+	}
+
+	for _, event := range events {
+		if err := e.When(event); err != nil {
+			return zero, false, fmt.Errorf("replaying event %d of aggregate %s: %w", event.AggregateSequence, aggregateId, err)
+		}
+	}
+
+	if version == 0 {
+		e.SetCreationDate(events[0].EventTime)
+	}
+	e.SetLastUpdateDate(last.EventTime)
+	e.SetVersion(last.AggregateSequence)
+	return e, true, nil
+}
+
+// NewEventSourcedRepository returns a repository of aggregates stored in
+// store. factory returns an empty aggregate to replay events into.
+func NewEventSourcedRepository[T Aggregate[S], S comparable](store EventStore, prefix string, factory func() T) Repository[T, S] {
+	return &EventSourcedRepository[T, S]{
+		store:   store,
+		prefix:  prefix,
+		factory: factory,
+		codec:   GobCodec{},
+	}
+}
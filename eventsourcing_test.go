@@ -0,0 +1,119 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type Chore struct {
+	common.AggregateBase[string]
+	Title string
+	Done  bool
+}
+
+type ChoreOpened struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+func (c *Chore) When(event common.Event) error {
+	switch event.EventType {
+	case "choreOpened":
+		p, err := common.DecodePayload[ChoreOpened](event)
+		if err != nil {
+			return err
+		}
+		c.ID = p.ID
+		c.Title = p.Title
+	case "choreDone":
+		c.Done = true
+	}
+	return nil
+}
+
+func OpenChore(id, title string) *Chore {
+	c := &Chore{}
+	c.Apply(c, "choreOpened", ChoreOpened{ID: id, Title: title})
+	return c
+}
+
+func (c *Chore) Complete() error {
+	return c.Apply(c, "choreDone", struct{}{})
+}
+
+func TestEventSourcedRepository(t *testing.T) {
+	store := common.NewInMemoryEventStore()
+	repo := common.NewEventSourcedRepository[*Chore](store, "chore", func() *Chore { return &Chore{} })
+
+	ctx := context.Background()
+
+	if err := repo.Create(ctx, OpenChore("1", "mop floor")); err != nil {
+		t.Fatalf("Error creating aggregate: %v", err)
+	}
+
+	c, err := repo.Get(ctx, "1")
+	if err != nil || c == nil {
+		t.Fatalf("Error getting aggregate: %v", err)
+	}
+
+	if c.Title != "mop floor" || c.Version != 1 {
+		t.Errorf("Aggregate was not replayed: %+v", c)
+	}
+
+	stale, _ := repo.Get(ctx, "1")
+
+	c.Complete()
+	if err := repo.Save(ctx, c); err != nil {
+		t.Fatalf("Error saving aggregate: %v", err)
+	}
+
+	stale.Complete()
+	if err := repo.Save(ctx, stale); !errors.Is(err, common.ErrConcurrencyConflict) {
+		t.Errorf("Saving a stale aggregate should conflict: %v", err)
+	}
+
+	c, _ = repo.Get(ctx, "1")
+	if !c.Done || c.Version != 2 {
+		t.Errorf("Aggregate was not replayed: %+v", c)
+	}
+
+	events, _ := store.Load(ctx, "1", 1)
+	if len(events) != 1 || events[0].AggregateSequence != 2 || events[0].AggregateType != "chore" {
+		t.Errorf("Stored events are not correct: %+v", events)
+	}
+
+	if err := repo.Delete(ctx, c); err != nil {
+		t.Fatalf("Error deleting aggregate: %v", err)
+	}
+
+	ok, _ := repo.Exists(ctx, "1")
+	if ok {
+		t.Errorf("Deleted aggregate should not exist")
+	}
+
+	all, _ := repo.GetAll(ctx)
+	if len(all) != 0 {
+		t.Errorf("Deleted aggregate should not be listed: %d", len(all))
+	}
+}
+
+func TestInMemoryEventStoreTenants(t *testing.T) {
+	store := common.NewInMemoryEventStore()
+
+	acme := common.WithTenant(context.Background(), "acme")
+
+	store.Append(acme, "1", 0, []common.Event{{EventType: "choreOpened"}})
+
+	events, _ := store.Load(context.Background(), "1", 0)
+	if len(events) != 0 {
+		t.Errorf("Stream should not be visible to another tenant")
+	}
+
+	err := store.Append(acme, "1", 0, []common.Event{{EventType: "choreOpened"}})
+	if !errors.Is(err, common.ErrConcurrencyConflict) {
+		t.Errorf("Appending at an old version should conflict: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// AnyVersion skips the expected version check in Append.
+const AnyVersion = -1
+
+// ErrConcurrencyConflict is returned by Append when the aggregate has moved
+// on since the caller loaded it.
+var ErrConcurrencyConflict = errors.New("concurrency conflict")
+
+// EventStore is an append-only log of events grouped by aggregate. An
+// aggregate's version is the number of events in its stream, and each stored
+// event's AggregateSequence is its position in the stream, starting at 1.
+// Streams are partitioned by the tenant in ctx.
+type EventStore interface {
+	// Append adds events to the aggregate's stream if it is at
+	// expectedVersion, or returns ErrConcurrencyConflict.
+	Append(ctx context.Context, aggregateId string, expectedVersion int, events []Event) error
+	// Load returns the aggregate's events after fromVersion.
+	Load(ctx context.Context, aggregateId string, fromVersion int) ([]Event, error)
+	// AggregateIds returns the id of every aggregate with events.
+	AggregateIds(ctx context.Context) ([]string, error)
+}
+
+// StoredEvent is an event with its position in the store's global log.
+// Positions start at 1.
+type StoredEvent struct {
+	Position uint64 `json:"position"`
+	Event    Event  `json:"event"`
+}
+
+// EventLog is an event store read as a single log of every event, across all
+// tenants, in the order they were appended.
+type EventLog interface {
+	// Head returns the position of the last event.
+	Head(ctx context.Context) (uint64, error)
+	// ReadAll returns up to limit events after position.
+	ReadAll(ctx context.Context, after uint64, limit int) ([]StoredEvent, error)
+}
+
+// conflictError reports the version an aggregate was actually at.
+func conflictError(aggregateId string, expected, actual int) error {
+	return fmt.Errorf("%w: aggregate %s is at version %d, expected %d", ErrConcurrencyConflict, aggregateId, actual, expected)
+}
+
+// sequenceEvents sets the aggregate id and sequence of events appended to a
+// stream at version, and their tenant if they have none.
+func sequenceEvents(tenantId, aggregateId string, version int, events []Event) []Event {
+	sequenced := make([]Event, len(events))
+	for i, event := range events {
+		event.AggregateId = aggregateId
+		event.AggregateSequence = version + i + 1
+		if event.TenantId == "" {
+			event.TenantId = tenantId
+		}
+		sequenced[i] = event
+	}
+	return sequenced
+}
+
+type InMemoryEventStore struct {
+	mu      sync.RWMutex
+	streams map[string]map[string][]Event
+	ids     map[string][]string
+	log     []StoredEvent
+}
+
+func (s *InMemoryEventStore) Append(ctx context.Context, aggregateId string, expectedVersion int, events []Event) error {
+	tenantId := TenantFromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streams, ok := s.streams[tenantId]
+	if !ok {
+		streams = make(map[string][]Event)
+		s.streams[tenantId] = streams
+	}
+
+	stream, ok := streams[aggregateId]
+	if expectedVersion != AnyVersion && len(stream) != expectedVersion {
+		return conflictError(aggregateId, expectedVersion, len(stream))
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if !ok {
+		s.ids[tenantId] = append(s.ids[tenantId], aggregateId)
+	}
+
+	for _, event := range sequenceEvents(tenantId, aggregateId, len(stream), events) {
+		streams[aggregateId] = append(streams[aggregateId], event)
+		s.log = append(s.log, StoredEvent{Position: uint64(len(s.log)) + 1, Event: event})
+	}
+	return nil
+}
+
+func (s *InMemoryEventStore) Load(ctx context.Context, aggregateId string, fromVersion int) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stream := s.streams[TenantFromContext(ctx)][aggregateId]
+	if fromVersion >= len(stream) {
+		return []Event{}, nil
+	}
+	return append([]Event{}, stream[max(fromVersion, 0):]...), nil
+}
+
+func (s *InMemoryEventStore) AggregateIds(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string{}, s.ids[TenantFromContext(ctx)]...), nil
+}
+
+func (s *InMemoryEventStore) Head(ctx context.Context) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return uint64(len(s.log)), nil
+}
+
+func (s *InMemoryEventStore) ReadAll(ctx context.Context, after uint64, limit int) ([]StoredEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if after >= uint64(len(s.log)) {
+		return []StoredEvent{}, nil
+	}
+	end := min(after+uint64(limit), uint64(len(s.log)))
+	return append([]StoredEvent{}, s.log[after:end]...), nil
+}
+
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{
+		streams: make(map[string]map[string][]Event),
+		ids:     make(map[string][]string),
+	}
+}
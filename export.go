@@ -0,0 +1,247 @@
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const ExportFormat = "cleanlog-export/1"
+
+type ConflictPolicy int
+
+const (
+	ConflictSkip ConflictPolicy = iota
+	ConflictOverwrite
+	ConflictFail
+)
+
+var ErrImportConflict = errors.New("entity already exists")
+
+type ExportHeader struct {
+	Format        string    `json:"format"`
+	Type          string    `json:"type"`
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type ExportTrailer struct {
+	Count    int    `json:"count"`
+	Checksum string `json:"checksum"`
+}
+
+type exportRecord struct {
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// exportLine is one line of an export. Exactly one of the fields is set: the
+// header comes first, then one line per entity and finally the trailer.
+type exportLine struct {
+	Header  *ExportHeader  `json:"header,omitempty"`
+	Entity  *exportRecord  `json:"entity,omitempty"`
+	Trailer *ExportTrailer `json:"trailer,omitempty"`
+}
+
+type ExportOptions struct {
+	Type string
+	// Schemas gives the schema version recorded in the header, the current
+	// version of Type, which is what repositories return after upcasting.
+	Schemas *SchemaRegistry
+	// SchemaVersion is recorded in the header when Schemas is not set. It
+	// defaults to 1.
+	SchemaVersion int
+	Compress      bool
+}
+
+type ImportOptions struct {
+	// Type, when set, must match the type in the export header.
+	Type     string
+	Conflict ConflictPolicy
+	// Schemas upcasts entities exported at an older schema version.
+	Schemas *SchemaRegistry
+}
+
+type ImportResult struct {
+	Created     int
+	Overwritten int
+	Skipped     int
+}
+
+// Export writes every entity of repo to w as JSON lines, optionally gzip
+// compressed. Each entity carries a SHA-256 of its data and the trailer
+// carries a checksum over the whole export.
+func Export[T Entity[S], S comparable](ctx context.Context, repo Repository[T, S], w io.Writer, opts ExportOptions) (int, error) {
+	entities, err := repo.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var gz *gzip.Writer
+	if opts.Compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	enc := json.NewEncoder(w)
+
+	version := opts.SchemaVersion
+	if opts.Schemas != nil {
+		version = opts.Schemas.CurrentVersion(opts.Type)
+	}
+	if version == 0 {
+		version = 1
+	}
+
+	err = enc.Encode(exportLine{Header: &ExportHeader{
+		Format:        ExportFormat,
+		Type:          opts.Type,
+		SchemaVersion: version,
+		CreatedAt:     time.Now(),
+	}})
+	if err != nil {
+		return 0, err
+	}
+
+	total := sha256.New()
+	for _, e := range entities {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		sum := sha256.Sum256(data)
+		total.Write(sum[:])
+
+		err = enc.Encode(exportLine{Entity: &exportRecord{
+			Checksum: hex.EncodeToString(sum[:]),
+			Data:     data,
+		}})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = enc.Encode(exportLine{Trailer: &ExportTrailer{
+		Count:    len(entities),
+		Checksum: hex.EncodeToString(total.Sum(nil)),
+	}})
+	if err != nil {
+		return 0, err
+	}
+
+	// Closing writes the rest of the compressed data and the gzip footer.
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, fmt.Errorf("finishing compressed export: %w", err)
+		}
+	}
+
+	return len(entities), nil
+}
+
+// Import reads an export produced by Export into repo. Compressed exports are
+// detected automatically. Entities are written as they are read, so a failed
+// import may leave the entities before the failure in repo.
+func Import[T Entity[S], S comparable](ctx context.Context, repo Repository[T, S], r io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return result, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	dec := json.NewDecoder(br)
+
+	var line exportLine
+	if err := dec.Decode(&line); err != nil {
+		return result, fmt.Errorf("reading export header: %w", err)
+	}
+	header := line.Header
+	if header == nil || header.Format != ExportFormat {
+		return result, errors.New("export header is missing or has an unknown format")
+	}
+	if opts.Type != "" && header.Type != opts.Type {
+		return result, fmt.Errorf("export contains %s entities, expected %s", header.Type, opts.Type)
+	}
+
+	total := sha256.New()
+	count := 0
+	for {
+		line = exportLine{}
+		if err := dec.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) {
+				return result, errors.New("export is truncated: trailer is missing")
+			}
+			return result, err
+		}
+
+		if line.Trailer != nil {
+			if line.Trailer.Count != count {
+				return result, fmt.Errorf("export count mismatch: trailer has %d, read %d", line.Trailer.Count, count)
+			}
+			if line.Trailer.Checksum != hex.EncodeToString(total.Sum(nil)) {
+				return result, errors.New("export checksum mismatch")
+			}
+			return result, nil
+		}
+
+		if line.Entity == nil {
+			return result, errors.New("export contains an unknown line")
+		}
+
+		sum := sha256.Sum256(line.Entity.Data)
+		if line.Entity.Checksum != hex.EncodeToString(sum[:]) {
+			return result, fmt.Errorf("checksum mismatch for entity %d", count+1)
+		}
+		total.Write(sum[:])
+		count++
+
+		data := []byte(line.Entity.Data)
+		if opts.Schemas != nil {
+			var err error
+			data, err = opts.Schemas.Upcast(header.Type, header.SchemaVersion, JSONCodec{}, data)
+			if err != nil {
+				return result, err
+			}
+		}
+
+		var e T
+		if err := json.Unmarshal(data, &e); err != nil {
+			return result, err
+		}
+
+		exists, err := repo.Exists(ctx, e.GetID())
+		if err != nil {
+			return result, err
+		}
+
+		switch {
+		case !exists:
+			if err := repo.Create(ctx, e); err != nil {
+				return result, err
+			}
+			result.Created++
+		case opts.Conflict == ConflictOverwrite:
+			if err := repo.Save(ctx, e); err != nil {
+				return result, err
+			}
+			result.Overwritten++
+		case opts.Conflict == ConflictFail:
+			return result, fmt.Errorf("%w: %v", ErrImportConflict, e.GetID())
+		default:
+			result.Skipped++
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+
+	mc := &MockMemcacheClient{store: make(map[string][]byte)}
+	src := common.NewMemcacheRepository[*common.BaseEntity[string]]("", "test", mc)
+	src.Create(ctx, &common.BaseEntity[string]{ID: "1", Version: 1})
+	src.Create(ctx, &common.BaseEntity[string]{ID: "2", Version: 3})
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+
+		n, err := common.Export(ctx, src, &buf, common.ExportOptions{Type: "test", Compress: compress})
+		if err != nil {
+			t.Fatalf("Error exporting: %v", err)
+		}
+
+		if n != 2 {
+			t.Errorf("Exported count is not correct: %d", n)
+		}
+
+		dst := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+		dst.Create(ctx, &common.BaseEntity[string]{ID: "1", Version: 9})
+
+		res, err := common.Import(ctx, dst, bytes.NewReader(buf.Bytes()), common.ImportOptions{Type: "test"})
+		if err != nil {
+			t.Fatalf("Error importing: %v", err)
+		}
+
+		if res.Created != 1 || res.Skipped != 1 {
+			t.Errorf("Import result is not correct: %+v", res)
+		}
+
+		e, _ := dst.Get(ctx, "2")
+		if e == nil || e.Version != 3 {
+			t.Errorf("Imported entity is not correct: %+v", e)
+		}
+
+		res, err = common.Import(ctx, dst, bytes.NewReader(buf.Bytes()), common.ImportOptions{Conflict: common.ConflictOverwrite})
+		if err != nil {
+			t.Fatalf("Error importing: %v", err)
+		}
+
+		if res.Overwritten != 2 {
+			t.Errorf("Import result is not correct: %+v", res)
+		}
+
+		_, err = common.Import(ctx, dst, bytes.NewReader(buf.Bytes()), common.ImportOptions{Conflict: common.ConflictFail})
+		if !errors.Is(err, common.ErrImportConflict) {
+			t.Errorf("Import should fail on conflict: %v", err)
+		}
+
+		_, err = common.Import(ctx, dst, bytes.NewReader(buf.Bytes()), common.ImportOptions{Type: "other"})
+		if err == nil {
+			t.Errorf("Import should fail on type mismatch")
+		}
+	}
+}
+
+func TestImportChecksum(t *testing.T) {
+	ctx := context.Background()
+
+	src := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	src.Create(ctx, &common.BaseEntity[string]{ID: "1", Version: 1})
+
+	var buf bytes.Buffer
+	common.Export(ctx, src, &buf, common.ExportOptions{Type: "test"})
+
+	tampered := strings.Replace(buf.String(), `"version":1`, `"version":2`, 1)
+
+	dst := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	_, err := common.Import(ctx, dst, strings.NewReader(tampered), common.ImportOptions{})
+	if err == nil {
+		t.Errorf("Import should fail on checksum mismatch")
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	truncated := strings.Join(lines[:2], "")
+
+	_, err = common.Import(ctx, common.NewInMemoryRepository[*common.BaseEntity[string]](), strings.NewReader(truncated), common.ImportOptions{})
+	if err == nil {
+		t.Errorf("Import should fail when the trailer is missing")
+	}
+}
+
+type failingWriter struct {
+	accept int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.accept {
+		return 0, errors.New("disk full")
+	}
+	w.accept -= len(p)
+	return len(p), nil
+}
+
+func TestExportReportsUnfinishedCompression(t *testing.T) {
+	ctx := context.Background()
+
+	src := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	src.Create(ctx, &common.BaseEntity[string]{ID: "1", Version: 1})
+
+	// The gzip header fits, the compressed data written on close does not.
+	_, err := common.Export(ctx, src, &failingWriter{accept: 10}, common.ExportOptions{Type: "test", Compress: true})
+	if err == nil {
+		t.Errorf("Export should fail when the compressed data cannot be written")
+	}
+}
+
+func TestExportSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+
+	schemas := common.NewSchemaRegistry()
+	schemas.Register("test", 2)
+	schemas.AddUpcaster("test", 1, func(codec common.Codec, data []byte) ([]byte, error) {
+		return nil, errors.New("data is already current")
+	})
+
+	src := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	src.Create(ctx, &common.BaseEntity[string]{ID: "1", Version: 1})
+
+	var buf bytes.Buffer
+	if _, err := common.Export(ctx, src, &buf, common.ExportOptions{Type: "test", Schemas: schemas}); err != nil {
+		t.Fatalf("Error exporting: %v", err)
+	}
+
+	dst := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	if _, err := common.Import(ctx, dst, &buf, common.ImportOptions{Type: "test", Schemas: schemas}); err != nil {
+		t.Errorf("Current data should not be upcast again: %v", err)
+	}
+}
+
+type readOnlyRepository struct {
+	common.Repository[*common.BaseEntity[string], string]
+}
+
+func (r readOnlyRepository) Create(ctx context.Context, e *common.BaseEntity[string]) error {
+	return errors.New("read only")
+}
+
+func TestImportCountsOnlyWrittenEntities(t *testing.T) {
+	ctx := context.Background()
+
+	src := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	src.Create(ctx, &common.BaseEntity[string]{ID: "1", Version: 1})
+
+	var buf bytes.Buffer
+	common.Export(ctx, src, &buf, common.ExportOptions{Type: "test"})
+
+	dst := readOnlyRepository{common.NewInMemoryRepository[*common.BaseEntity[string]]()}
+	result, err := common.Import(ctx, dst, &buf, common.ImportOptions{Type: "test"})
+	if err == nil {
+		t.Fatal("Import should fail when an entity cannot be written")
+	}
+	if result.Created != 0 {
+		t.Errorf("Entity that was not written was counted: %+v", result)
+	}
+}
@@ -0,0 +1,553 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when FileEventStore fsyncs appended events.
+type SyncPolicy int
+
+const (
+	// SyncEveryAppend fsyncs before Append returns.
+	SyncEveryAppend SyncPolicy = iota
+	// SyncInterval fsyncs in the background every SyncInterval, so a crash
+	// can lose the most recent appends.
+	SyncInterval
+	// SyncNone leaves flushing to the operating system.
+	SyncNone
+)
+
+const (
+	defaultSegmentSize  = 64 << 20
+	defaultSyncInterval = time.Second
+	maxRecordSize       = 16 << 20
+	recordHeaderSize    = 8
+	segmentExt          = ".seg"
+)
+
+type FileEventStoreOptions struct {
+	// SegmentSize is the size at which a new segment file is started. The
+	// default is 64MB.
+	SegmentSize  int64
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+var (
+	// ErrStoreClosed is returned by a FileEventStore after Close.
+	ErrStoreClosed = errors.New("event store closed")
+	// ErrCorruptSegment is returned by NewFileEventStore when a segment has
+	// a bad record that is not a torn write at the end of the store.
+	ErrCorruptSegment = errors.New("corrupt event store segment")
+
+	errIncompleteRecord = errors.New("incomplete record")
+)
+
+// fileRecord is what each record in a segment holds.
+type fileRecord struct {
+	StoredEvent
+	Tenant string `json:"tenant,omitempty"`
+	// Batch is the number of records written by the Append this record is
+	// part of. Records from before batches were recorded have 0.
+	Batch int `json:"batch,omitempty"`
+}
+
+type segment struct {
+	file *os.File
+	size int64
+}
+
+type recordLocation struct {
+	seg    *segment
+	offset int64
+}
+
+// FileEventStore is an EventStore kept in append-only segment files under
+// dir. Each record is a 4 byte length and a 4 byte CRC32 followed by the
+// JSON encoded event. The indexes by aggregate and by position are held in
+// memory and rebuilt when the store is opened. An incomplete batch at the
+// end of the last segment, left by a crash during an Append, is truncated,
+// so an Append is either all there or not at all. Any other bad record is
+// reported as corruption rather than dropping the records after it.
+type FileEventStore struct {
+	dir  string
+	opts FileEventStoreOptions
+
+	mu          sync.RWMutex
+	segments    []*segment
+	positions   []recordLocation
+	aggregates  map[string]map[string][]uint64
+	ids         map[string][]string
+	dirty       bool
+	closed      bool
+	appended    chan struct{}
+	stopSyncing chan struct{}
+	syncDone    chan struct{}
+}
+
+func (s *FileEventStore) Append(ctx context.Context, aggregateId string, expectedVersion int, events []Event) error {
+	tenantId := TenantFromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	stream := s.aggregates[tenantId][aggregateId]
+	if expectedVersion != AnyVersion && len(stream) != expectedVersion {
+		return conflictError(aggregateId, expectedVersion, len(stream))
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	seg, err := s.activeSegment()
+	if err != nil {
+		return err
+	}
+
+	head := s.head()
+	var buf []byte
+	offsets := make([]int64, len(events))
+	for i, event := range sequenceEvents(tenantId, aggregateId, len(stream), events) {
+		rec, err := encodeRecord(fileRecord{
+			StoredEvent: StoredEvent{Position: head + uint64(i) + 1, Event: event},
+			Tenant:      tenantId,
+			Batch:       len(events),
+		})
+		if err != nil {
+			return err
+		}
+		offsets[i] = seg.size + int64(len(buf))
+		buf = append(buf, rec...)
+	}
+
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		// Drop whatever part of the batch was written.
+		seg.file.Truncate(seg.size)
+		return fmt.Errorf("appending to event store: %w", err)
+	}
+
+	if s.opts.Sync == SyncEveryAppend {
+		if err := seg.file.Sync(); err != nil {
+			seg.file.Truncate(seg.size)
+			return fmt.Errorf("syncing event store: %w", err)
+		}
+	} else {
+		s.dirty = true
+	}
+
+	seg.size += int64(len(buf))
+	for i := range events {
+		s.index(tenantId, aggregateId, recordLocation{seg: seg, offset: offsets[i]})
+	}
+
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return nil
+}
+
+func (s *FileEventStore) Load(ctx context.Context, aggregateId string, fromVersion int) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stream := s.aggregates[TenantFromContext(ctx)][aggregateId]
+
+	events := []Event{}
+	for _, pos := range stream[min(max(fromVersion, 0), len(stream)):] {
+		rec, err := s.read(pos)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, rec.Event)
+	}
+	return events, nil
+}
+
+func (s *FileEventStore) AggregateIds(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string{}, s.ids[TenantFromContext(ctx)]...), nil
+}
+
+func (s *FileEventStore) Head(ctx context.Context) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.head(), nil
+}
+
+func (s *FileEventStore) ReadAll(ctx context.Context, after uint64, limit int) ([]StoredEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []StoredEvent{}
+	for pos := after + 1; pos <= s.head() && len(events) < limit; pos++ {
+		rec, err := s.read(pos)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, rec.StoredEvent)
+	}
+	return events, nil
+}
+
+// Subscribe calls handler for every event after position, across all
+// tenants, and then for each new event as it is appended. It blocks until
+// ctx is done, the store is closed or handler returns an error.
+func (s *FileEventStore) Subscribe(ctx context.Context, after uint64, handler func(StoredEvent) error) error {
+	for {
+		s.mu.RLock()
+		appended := s.appended
+		closed := s.closed
+		s.mu.RUnlock()
+
+		if closed {
+			return ErrStoreClosed
+		}
+
+		events, err := s.ReadAll(ctx, after, 100)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := handler(event); err != nil {
+				return err
+			}
+			after = event.Position
+		}
+
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// Close syncs and closes the segment files.
+func (s *FileEventStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.appended)
+	s.mu.Unlock()
+
+	if s.stopSyncing != nil {
+		close(s.stopSyncing)
+		<-s.syncDone
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	if len(s.segments) > 0 {
+		errs = append(errs, s.segments[len(s.segments)-1].file.Sync())
+	}
+	for _, seg := range s.segments {
+		errs = append(errs, seg.file.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *FileEventStore) head() uint64 {
+	return uint64(len(s.positions))
+}
+
+func (s *FileEventStore) index(tenantId, aggregateId string, loc recordLocation) {
+	s.positions = append(s.positions, loc)
+
+	streams, ok := s.aggregates[tenantId]
+	if !ok {
+		streams = make(map[string][]uint64)
+		s.aggregates[tenantId] = streams
+	}
+	if _, ok := streams[aggregateId]; !ok {
+		s.ids[tenantId] = append(s.ids[tenantId], aggregateId)
+	}
+	streams[aggregateId] = append(streams[aggregateId], s.head())
+}
+
+func (s *FileEventStore) read(pos uint64) (fileRecord, error) {
+	loc := s.positions[pos-1]
+	rec, _, err := readRecord(loc.seg.file, loc.offset, loc.seg.size)
+	if err != nil {
+		return rec, fmt.Errorf("reading event %d: %w", pos, err)
+	}
+	return rec, nil
+}
+
+// activeSegment returns the segment to append to, starting a new one when
+// the last is full.
+func (s *FileEventStore) activeSegment() (*segment, error) {
+	if n := len(s.segments); n > 0 && s.segments[n-1].size < s.opts.SegmentSize {
+		return s.segments[n-1], nil
+	}
+
+	if n := len(s.segments); n > 0 {
+		if err := s.segments[n-1].file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Segments are named after their first position, so they sort in order.
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.head()+1, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{file: f}
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+func (s *FileEventStore) syncInBackground() {
+	defer close(s.syncDone)
+
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopSyncing:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty && len(s.segments) > 0 {
+				if err := s.segments[len(s.segments)-1].file.Sync(); err != nil {
+					slog.Error("Error syncing event store", "dir", s.dir, "error", err)
+				} else {
+					s.dirty = false
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// open loads the segments in dir and rebuilds the indexes.
+func (s *FileEventStore) open() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), segmentExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+
+		seg := &segment{file: f}
+		s.segments = append(s.segments, seg)
+
+		if err := s.scan(seg, i == len(names)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan indexes the records in seg. A bad record at the end of the last
+// segment is a torn write and the batch it belongs to is truncated; anywhere
+// else it is corruption.
+func (s *FileEventStore) scan(seg *segment, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	for seg.size < size {
+		recs, offsets, n, bad, err := s.readBatch(seg, size)
+		if err != nil {
+			if !last || !tornTail(seg.file, bad, size) {
+				return fmt.Errorf("%w: %s at offset %d: %w", ErrCorruptSegment, seg.file.Name(), bad, err)
+			}
+			slog.Warn("Truncating torn event store tail", "segment", seg.file.Name(), "offset", seg.size, "error", err)
+			return seg.file.Truncate(seg.size)
+		}
+
+		for i, rec := range recs {
+			s.index(rec.Tenant, rec.Event.AggregateId, recordLocation{seg: seg, offset: offsets[i]})
+		}
+		seg.size += n
+	}
+	return nil
+}
+
+// readBatch reads the batch of records starting at the end of seg's indexed
+// records and returns them with their offsets and their length on disk. On
+// error it returns the offset of the record that could not be read.
+func (s *FileEventStore) readBatch(seg *segment, size int64) ([]fileRecord, []int64, int64, int64, error) {
+	var recs []fileRecord
+	var offsets []int64
+
+	offset := seg.size
+	for count := 1; len(recs) < count; {
+		rec, n, err := readRecord(seg.file, offset, size)
+		if err != nil {
+			return nil, nil, 0, offset, err
+		}
+
+		want := s.head() + uint64(len(recs)) + 1
+		if rec.Position != want {
+			return nil, nil, 0, offset, fmt.Errorf("record has position %d, expected %d", rec.Position, want)
+		}
+		if len(recs) == 0 {
+			count = max(rec.Batch, 1)
+		} else if rec.Batch != count {
+			return nil, nil, 0, offset, fmt.Errorf("record %d is not part of the batch before it", rec.Position)
+		}
+
+		recs = append(recs, rec)
+		offsets = append(offsets, offset)
+		offset += n
+	}
+	return recs, offsets, offset - seg.size, 0, nil
+}
+
+// tornTail reports whether the bad record at offset was left by a write cut
+// short by a crash: it runs past the end of the segment, or it is unreadable
+// and no readable record follows it. A readable record that is out of place,
+// or a bad one with good records after it, is corruption.
+func tornTail(f *os.File, offset, size int64) bool {
+	_, n, err := readRecord(f, offset, size)
+	switch {
+	case errors.Is(err, errIncompleteRecord):
+		return true
+	case err == nil || n == 0:
+		return false
+	}
+
+	for offset += n; offset < size; offset += n {
+		_, n, err = readRecord(f, offset, size)
+		if err == nil {
+			return false
+		}
+		if errors.Is(err, errIncompleteRecord) || n == 0 {
+			return true
+		}
+	}
+	return true
+}
+
+func encodeRecord(rec fileRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(payload))
+	return append(b, payload...), nil
+}
+
+// readRecord reads the record at offset in a segment of size bytes and
+// returns it with its length on disk. The length is also returned for a
+// record that is complete but unreadable.
+func readRecord(f *os.File, offset, size int64) (fileRecord, int64, error) {
+	var rec fileRecord
+
+	if offset+recordHeaderSize > size {
+		return rec, 0, fmt.Errorf("%w header", errIncompleteRecord)
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return rec, 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+recordHeaderSize+length > size {
+		return rec, 0, errIncompleteRecord
+	}
+	if length > maxRecordSize {
+		return rec, 0, fmt.Errorf("record length %d is too large", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return rec, 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return rec, recordHeaderSize + length, errors.New("record checksum mismatch")
+	}
+
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, recordHeaderSize + length, err
+	}
+	return rec, recordHeaderSize + length, nil
+}
+
+// NewFileEventStore opens the event store in dir, creating it if needed.
+func NewFileEventStore(dir string, opts FileEventStoreOptions) (*FileEventStore, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileEventStore{
+		dir:        dir,
+		opts:       opts,
+		aggregates: make(map[string]map[string][]uint64),
+		ids:        make(map[string][]string),
+		appended:   make(chan struct{}),
+	}
+
+	if err := s.open(); err != nil {
+		for _, seg := range s.segments {
+			seg.file.Close()
+		}
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		s.stopSyncing = make(chan struct{})
+		s.syncDone = make(chan struct{})
+		go s.syncInBackground()
+	}
+
+	return s, nil
+}
@@ -0,0 +1,185 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestFileEventStore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := common.NewFileEventStore(dir, common.FileEventStoreOptions{SegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := store.Append(ctx, "1", i, []common.Event{{EventId: common.NewEventId(), EventType: "choreDone"}}); err != nil {
+			t.Fatalf("Error appending: %v", err)
+		}
+	}
+	store.Append(ctx, "2", 0, []common.Event{{EventType: "choreOpened"}})
+
+	if err := store.Append(ctx, "1", 3, []common.Event{{EventType: "choreDone"}}); !errors.Is(err, common.ErrConcurrencyConflict) {
+		t.Errorf("Appending at an old version should conflict: %v", err)
+	}
+
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) < 2 {
+		t.Errorf("Store did not roll over to a new segment: %v", segments)
+	}
+
+	// Simulate a crash part way through writing a record.
+	last := segments[len(segments)-1]
+	f, _ := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	f.Close()
+
+	store, err = common.NewFileEventStore(dir, common.FileEventStoreOptions{SegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	defer store.Close()
+
+	head, _ := store.Head(ctx)
+	if head != 6 {
+		t.Errorf("Head is not correct after reopening: %d", head)
+	}
+
+	events, err := store.Load(ctx, "1", 2)
+	if err != nil {
+		t.Fatalf("Error loading events: %v", err)
+	}
+	if len(events) != 3 || events[0].AggregateSequence != 3 {
+		t.Errorf("Loaded events are not correct: %+v", events)
+	}
+
+	if err := store.Append(ctx, "2", 1, []common.Event{{EventType: "choreDone"}}); err != nil {
+		t.Fatalf("Error appending after recovery: %v", err)
+	}
+
+	all, _ := store.ReadAll(ctx, 5, 10)
+	if len(all) != 2 || all[0].Position != 6 || all[1].Event.AggregateId != "2" {
+		t.Errorf("Events by position are not correct: %+v", all)
+	}
+}
+
+func TestFileEventStoreSubscribe(t *testing.T) {
+	store, err := common.NewFileEventStore(t.TempDir(), common.FileEventStoreOptions{Sync: common.SyncInterval, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	store.Append(ctx, "1", 0, []common.Event{{EventType: "choreOpened"}})
+
+	received := make(chan common.StoredEvent, 10)
+	go store.Subscribe(ctx, 0, func(event common.StoredEvent) error {
+		received <- event
+		return nil
+	})
+
+	if ev := <-received; ev.Position != 1 {
+		t.Errorf("Existing event was not delivered: %+v", ev)
+	}
+
+	store.Append(ctx, "1", 1, []common.Event{{EventType: "choreDone"}})
+
+	select {
+	case ev := <-received:
+		if ev.Position != 2 || ev.Event.EventType != "choreDone" {
+			t.Errorf("Appended event is not correct: %+v", ev)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Appended event was not delivered")
+	}
+}
+
+func TestFileEventStoreTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := common.NewFileEventStore(dir, common.FileEventStoreOptions{})
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+
+	store.Append(ctx, "1", 0, []common.Event{{EventType: "choreOpened"}})
+	store.Append(ctx, "1", 1, []common.Event{{EventType: "choreDone"}, {EventType: "choreDone"}, {EventType: "choreClosed"}})
+	store.Close()
+
+	// Simulate a crash part way through writing the last record of the batch.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	info, _ := os.Stat(segments[0])
+	os.Truncate(segments[0], info.Size()-5)
+
+	store, err = common.NewFileEventStore(dir, common.FileEventStoreOptions{})
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	defer store.Close()
+
+	if head, _ := store.Head(ctx); head != 1 {
+		t.Errorf("Incomplete batch should be dropped: head is %d", head)
+	}
+
+	if err := store.Append(ctx, "1", 1, []common.Event{{EventType: "choreDone"}}); err != nil {
+		t.Fatalf("Error appending after recovery: %v", err)
+	}
+}
+
+func TestFileEventStoreCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := common.NewFileEventStore(dir, common.FileEventStoreOptions{})
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		store.Append(ctx, "1", i, []common.Event{{EventType: "choreDone"}})
+	}
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	data, _ := os.ReadFile(segments[0])
+
+	// A bad last record is a torn write and only that batch is dropped.
+	last := append([]byte(nil), data...)
+	last[len(last)-2] ^= 0xff
+	os.WriteFile(segments[0], last, 0644)
+
+	store, err = common.NewFileEventStore(dir, common.FileEventStoreOptions{})
+	if err != nil {
+		t.Fatalf("Error reopening store with a torn tail: %v", err)
+	}
+	if head, _ := store.Head(ctx); head != 4 {
+		t.Errorf("Only the torn batch should be dropped: head is %d", head)
+	}
+	store.Close()
+
+	// A bad record with good ones after it is corruption, not a torn write.
+	first := append([]byte(nil), data...)
+	first[10] ^= 0xff
+	os.WriteFile(segments[0], first, 0644)
+
+	if _, err := common.NewFileEventStore(dir, common.FileEventStoreOptions{}); !errors.Is(err, common.ErrCorruptSegment) {
+		t.Fatalf("Corruption should be reported rather than truncated: %v", err)
+	}
+
+	if info, _ := os.Stat(segments[0]); info.Size() != int64(len(data)) {
+		t.Errorf("Corrupt segment was truncated: %d bytes left of %d", info.Size(), len(data))
+	}
+}
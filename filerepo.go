@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileRepository stores each entity in its own file under dir, one directory
+// per tenant. Files start with a 4 byte schema version followed by the codec
+// encoded entity.
+type FileRepository[T Entity[S], S comparable] struct {
+	dir     string
+	prefix  string
+	codec   Codec
+	schemas *SchemaRegistry
+	mu      sync.RWMutex
+}
+
+func (fr *FileRepository[T, S]) Create(ctx context.Context, e T) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	path := fr.path(ctx, e.GetID())
+	if _, err := os.Stat(path); err == nil {
+		return errors.New("entity already exists")
+	}
+	return fr.write(path, e)
+}
+
+func (fr *FileRepository[T, S]) Save(ctx context.Context, e T) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	path := fr.path(ctx, e.GetID())
+	if _, err := os.Stat(path); err != nil {
+		return errors.New("entity not found")
+	}
+	return fr.write(path, e)
+}
+
+func (fr *FileRepository[T, S]) Get(ctx context.Context, id S) (T, error) {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+
+	var zero T
+	e, err := fr.read(fr.path(ctx, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return zero, nil
+	}
+	return e, err
+}
+
+func (fr *FileRepository[T, S]) GetAll(ctx context.Context) ([]T, error) {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+
+	es := []T{}
+
+	files, err := os.ReadDir(fr.tenantDir(ctx))
+	if errors.Is(err, os.ErrNotExist) {
+		return es, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".dat") {
+			continue
+		}
+		e, err := fr.read(filepath.Join(fr.tenantDir(ctx), f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+func (fr *FileRepository[T, S]) Delete(ctx context.Context, e T) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	err := os.Remove(fr.path(ctx, e.GetID()))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("entity not found")
+	}
+	return err
+}
+
+func (fr *FileRepository[T, S]) Exists(ctx context.Context, id S) (bool, error) {
+	_, err := os.Stat(fr.path(ctx, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (fr *FileRepository[T, S]) GetId(ctx context.Context, e T) (S, error) {
+	return e.GetID(), nil
+}
+
+func (fr *FileRepository[T, S]) SetCodec(codec Codec) error {
+	fr.codec = codec
+	return nil
+}
+
+func (fr *FileRepository[T, S]) SetSchemaRegistry(schemas *SchemaRegistry) error {
+	fr.schemas = schemas
+	return nil
+}
+
+func (fr *FileRepository[T, S]) tenantDir(ctx context.Context) string {
+	tenantId := TenantFromContext(ctx)
+	if tenantId == "" {
+		return fr.dir
+	}
+	return filepath.Join(fr.dir, "tenant-"+url.PathEscape(tenantId))
+}
+
+func (fr *FileRepository[T, S]) path(ctx context.Context, id S) string {
+	return filepath.Join(fr.tenantDir(ctx), url.PathEscape(fmt.Sprint(id))+".dat")
+}
+
+func (fr *FileRepository[T, S]) write(path string, e T) error {
+	value, err := fr.codec.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	if fr.schemas != nil {
+		version = fr.schemas.CurrentVersion(fr.prefix)
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, uint32(version))
+	b = append(b, value...)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial entity.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (fr *FileRepository[T, S]) read(path string) (T, error) {
+	var entity T
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return entity, err
+	}
+	if len(b) < 4 {
+		return entity, fmt.Errorf("entity file %s is truncated", path)
+	}
+
+	value := b[4:]
+	if fr.schemas != nil {
+		value, err = fr.schemas.Upcast(fr.prefix, int(binary.BigEndian.Uint32(b)), fr.codec, value)
+		if err != nil {
+			return entity, err
+		}
+	}
+
+	err = fr.codec.Unmarshal(value, &entity)
+	return entity, err
+}
+
+func NewFileRepository[T Entity[S], S comparable](dir string, prefix string) Repository[T, S] {
+	return &FileRepository[T, S]{
+		dir:    filepath.Join(dir, prefix),
+		prefix: prefix,
+		codec:  GobCodec{},
+	}
+}
@@ -0,0 +1,58 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestFileRepository(t *testing.T) {
+	repo := common.NewFileRepository[*common.BaseEntity[string]](t.TempDir(), "test")
+
+	ctx := context.Background()
+
+	err := repo.Create(ctx, &common.BaseEntity[string]{ID: "a/1", Version: 1})
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	err = repo.Create(ctx, &common.BaseEntity[string]{ID: "a/1"})
+	if err == nil {
+		t.Errorf("Creating a duplicate entity should fail")
+	}
+
+	err = repo.Save(ctx, &common.BaseEntity[string]{ID: "a/1", Version: 2})
+	if err != nil {
+		t.Fatalf("Error saving entity: %v", err)
+	}
+
+	e, err := repo.Get(ctx, "a/1")
+	if err != nil {
+		t.Fatalf("Error getting entity: %v", err)
+	}
+
+	if e.Version != 2 {
+		t.Errorf("Entity version is not correct: %d", e.Version)
+	}
+
+	ok, _ := repo.Exists(common.WithTenant(ctx, "acme"), "a/1")
+	if ok {
+		t.Errorf("Entity should not be visible to another tenant")
+	}
+
+	all, err := repo.GetAll(ctx)
+	if err != nil || len(all) != 1 {
+		t.Errorf("GetAll is not correct: %v %v", all, err)
+	}
+
+	err = repo.Delete(ctx, e)
+	if err != nil {
+		t.Fatalf("Error deleting entity: %v", err)
+	}
+
+	ok, _ = repo.Exists(ctx, "a/1")
+	if ok {
+		t.Errorf("Entity should not exist")
+	}
+}
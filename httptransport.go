@@ -4,40 +4,49 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 type HttpTransport struct {
 	ctx            context.Context
 	lastId         string
+	streamId       string
 	postUri        string
 	streamUri      string
 	scanner        *bufio.Scanner
 	defaultRetries int
 	connected      bool
+	mu             sync.Mutex
 	body           io.ReadCloser
+	signer         Signer
+}
+
+// SetSigner signs every posted event with signer. Without a signer events
+// only carry their SHA.
+func (ht *HttpTransport) SetSigner(signer Signer) {
+	ht.signer = signer
 }
 
 func (ht *HttpTransport) PostEvent(event Event) error {
-	ev, err := json.Marshal(event)
+	return ht.PostEventContext(context.Background(), event)
+}
+
+// PostEventContext posts event like PostEvent, giving up when ctx is done,
+// including while waiting to retry.
+func (ht *HttpTransport) PostEventContext(ctx context.Context, event Event) error {
+	err := SignEvent(&event, ht.signer)
 	if err != nil {
 		return err
 	}
 
-	h := sha256.New()
-
-	h.Write([]byte(ev))
-
-	event.EventSHA = fmt.Sprintf("%x", h.Sum(nil))
-
-	ev, err = json.Marshal(event)
+	ev, err := json.Marshal(event)
 
 	if err != nil {
 		return err
@@ -45,7 +54,7 @@ func (ht *HttpTransport) PostEvent(event Event) error {
 
 	client := NewRetryableClient(10)
 
-	r, err := http.NewRequest("POST", ht.postUri, bytes.NewBuffer(ev))
+	r, err := http.NewRequestWithContext(ctx, "POST", ht.postUri, bytes.NewBuffer(ev))
 
 	if err != nil {
 		return err
@@ -65,42 +74,88 @@ func (ht *HttpTransport) PostEvent(event Event) error {
 
 	return nil
 }
-func decodeEvent(ev string) Event {
+
+// EventDecodeError is returned by NextEvent for an event that could not be
+// decoded. The stream itself is still usable.
+type EventDecodeError struct {
+	Data string
+	Err  error
+}
+
+func (e *EventDecodeError) Error() string {
+	return fmt.Sprintf("Error decoding event: %s : %v", e.Data, e.Err)
+}
+
+func (e *EventDecodeError) Unwrap() error {
+	return e.Err
+}
+
+func decodeEvent(ev string) (Event, error) {
 	var event Event
 	err := json.Unmarshal([]byte(ev), &event)
 	if err != nil {
-		log.Fatalf("Error decoding event: %s : %v", ev, err)
+		return event, &EventDecodeError{Data: ev, Err: err}
 	}
-	return event
+	return event, nil
 }
+
+// NextEvent returns the next event on the stream. Events are dispatched at
+// the blank line that ends them, so the id line may come before or after the
+// data, and LastEventId is the id of the event just returned.
 func (ht *HttpTransport) NextEvent() (*Event, error) {
 
-	var event Event
+	if ht.scanner == nil {
+		return nil, errors.New("not connected to event stream")
+	}
 
+	ht.streamId = ""
+
+	var data []string
 	for ht.scanner.Scan() {
 
 		select {
 		case <-ht.ctx.Done():
-			ht.body.Close()
+			ht.Close()
 			return nil, nil
 		default:
 			e := ht.scanner.Text()
 			switch {
-			case strings.HasPrefix(e, "event: "):
-				slog.Debug("Event Type", "Type", strings.TrimLeft(e, "event: "))
-			case strings.HasPrefix(e, "data: "):
-				slog.Debug("Event Data", "Data", strings.TrimLeft(e, "data: "))
-				event = decodeEvent(strings.TrimLeft(e, "data: "))
+			case e == "":
+				if len(data) == 0 {
+					continue
+				}
+				event, err := decodeEvent(strings.Join(data, "\n"))
+				if err != nil {
+					return nil, err
+				}
 				return &event, nil
-			case strings.HasPrefix(e, "id: "):
-				slog.Debug("Event Id", "Id", strings.TrimLeft(e, "id: "))
-				ht.lastId = strings.TrimLeft(e, "id: ")
+			case strings.HasPrefix(e, "event:"):
+				slog.Debug("Event Type", "Type", sseField(e, "event:"))
+			case strings.HasPrefix(e, "data:"):
+				slog.Debug("Event Data", "Data", sseField(e, "data:"))
+				data = append(data, sseField(e, "data:"))
+			case strings.HasPrefix(e, "id:"):
+				slog.Debug("Event Id", "Id", sseField(e, "id:"))
+				ht.lastId = sseField(e, "id:")
+				ht.streamId = ht.lastId
 			default:
 				break
 			}
 		}
 	}
-	return &event, nil
+
+	ht.connected = false
+
+	if err := ht.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// sseField returns the value of an event stream line, without the field name
+// and the single space that may follow it.
+func sseField(line, field string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(line, field), " ")
 }
 
 func (ht *HttpTransport) Connect(ctx context.Context) error {
@@ -111,10 +166,10 @@ func (ht *HttpTransport) Connect(ctx context.Context) error {
 
 	client := NewRetryableClient(ht.defaultRetries)
 
-	req, err := http.NewRequest("GET", ht.streamUri, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", ht.streamUri, nil)
 
 	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
+		return fmt.Errorf("Error creating request: %w", err)
 	}
 
 	req.Header.Set("Accept", "text/event-stream")
@@ -123,11 +178,19 @@ func (ht *HttpTransport) Connect(ctx context.Context) error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Error connecting to event stream: %v", err)
+		return fmt.Errorf("Error connecting to event stream: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Error: status code %d", resp.StatusCode)
+		resp.Body.Close()
+		return fmt.Errorf("Error: status code %d", resp.StatusCode)
+	}
+
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if ht.body != nil {
+		ht.body.Close()
 	}
 
 	slog.Info("Connected to event stream", "URI", req.URL)
@@ -140,6 +203,41 @@ func (ht *HttpTransport) Connect(ctx context.Context) error {
 
 	return nil
 }
+
+// Close closes the event stream, so a blocked NextEvent returns. It is safe
+// to call from another goroutine. Events can still be posted.
+func (ht *HttpTransport) Close() error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if ht.body == nil {
+		return nil
+	}
+
+	err := ht.body.Close()
+	ht.body = nil
+	return err
+}
+
+// SetLastEventId sets the Last-Event-ID sent on the next Connect. It must be
+// an id the stream sent, as returned by LastEventId.
+func (ht *HttpTransport) SetLastEventId(id string) {
+	ht.lastId = id
+}
+
+// LastEventId returns the last id the stream sent, which is what the server
+// resumes from. As in the event stream format it carries over to later
+// events that have no id of their own.
+func (ht *HttpTransport) LastEventId() string {
+	return ht.lastId
+}
+
+// StreamId returns the id the stream sent with the last event returned by
+// NextEvent, or "" if that event had none. It is not the EventId.
+func (ht *HttpTransport) StreamId() string {
+	return ht.streamId
+}
+
 func NewHttpTransport(postUri, streamUri string, retries int) *HttpTransport {
 
 	return &HttpTransport{
@@ -3,21 +3,38 @@ package common
 import (
 	"context"
 	"errors"
+	"sync"
 )
 
 type InMemoryRepository[T Entity[S], S comparable] struct {
-	entities map[S]*T
+	mu      sync.RWMutex
+	tenants map[string]map[S]*T
+}
+
+// entities returns the tenant's entities, creating them if needed. Callers
+// must hold the write lock.
+func (wri *InMemoryRepository[T, S]) entities(ctx context.Context) map[S]*T {
+	tenantId := TenantFromContext(ctx)
+	entities, ok := wri.tenants[tenantId]
+	if !ok {
+		entities = make(map[S]*T)
+		wri.tenants[tenantId] = entities
+	}
+	return entities
 }
 
 func (wri *InMemoryRepository[T, S]) Create(ctx context.Context, e T) error {
 
 	id := e.GetID()
 
-	if _, ok := wri.entities[id]; ok {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
+	if _, ok := wri.entities(ctx)[id]; ok {
 		return errors.New("entity already exists")
 	}
 
-	wri.entities[id] = &e
+	wri.entities(ctx)[id] = &e
 
 	return nil
 }
@@ -25,19 +42,25 @@ func (wri *InMemoryRepository[T, S]) Save(ctx context.Context, e T) error {
 
 	id := e.GetID()
 
-	if _, ok := wri.entities[id]; !ok {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
+	if _, ok := wri.entities(ctx)[id]; !ok {
 		return errors.New("entity not found")
 	}
 
-	wri.entities[id] = &e
+	wri.entities(ctx)[id] = &e
 
 	return nil
 }
 
 func (wri *InMemoryRepository[T, S]) Get(ctx context.Context, id S) (T, error) {
 
+	wri.mu.RLock()
+	defer wri.mu.RUnlock()
+
 	var zero T
-	wl, ok := wri.entities[id]
+	wl, ok := wri.tenants[TenantFromContext(ctx)][id]
 	if !ok {
 		return zero, nil
 	}
@@ -47,8 +70,11 @@ func (wri *InMemoryRepository[T, S]) Get(ctx context.Context, id S) (T, error) {
 
 func (wri *InMemoryRepository[T, S]) GetAll(ctx context.Context) ([]T, error) {
 
+	wri.mu.RLock()
+	defer wri.mu.RUnlock()
+
 	es := []T{}
-	for _, e := range wri.entities {
+	for _, e := range wri.tenants[TenantFromContext(ctx)] {
 		es = append(es, *e)
 	}
 
@@ -61,10 +87,14 @@ func (wri *InMemoryRepository[T, S]) Delete(ctx context.Context, e T) error {
 	if err != nil {
 		return err
 	}
-	if _, ok := wri.entities[id]; !ok {
+
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
+	if _, ok := wri.entities(ctx)[id]; !ok {
 		return errors.New("entity not found")
 	}
-	delete(wri.entities, id)
+	delete(wri.entities(ctx), id)
 	return nil
 }
 
@@ -77,11 +107,14 @@ func (wri *InMemoryRepository[T, S]) GetId(ctx context.Context, e T) (S, error)
 
 func (wri *InMemoryRepository[T, S]) Exists(ctx context.Context, id S) (bool, error) {
 
-	_, ok := wri.entities[id]
+	wri.mu.RLock()
+	defer wri.mu.RUnlock()
+
+	_, ok := wri.tenants[TenantFromContext(ctx)][id]
 	return ok, nil
 }
 func NewInMemoryRepository[T Entity[S], S comparable]() Repository[T, S] {
 	return &InMemoryRepository[T, S]{
-		entities: make(map[S]*T),
+		tenants: make(map[string]map[S]*T),
 	}
 }
@@ -0,0 +1,274 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHMAC    = "HS256"
+	SignatureEd25519 = "Ed25519"
+)
+
+type VerifyPolicy int
+
+const (
+	// VerifyReject returns the verification error from HandleEvent and the
+	// event is not handled.
+	VerifyReject VerifyPolicy = iota
+	// VerifyLog logs the failure and handles the event anyway.
+	VerifyLog
+	// VerifyQuarantine passes the event to the verifier's Quarantine func
+	// and does not handle it.
+	VerifyQuarantine
+)
+
+var ErrEventIntegrity = errors.New("event integrity check failed")
+
+// canonicalEvent lists the envelope fields covered by the SHA and signature,
+// in a fixed order. It is deliberately separate from Event: consumers built
+// against an older Event must hash the same bytes as newer producers, so
+// fields added to Event later are not covered unless they are added here in
+// a release every consumer has.
+type canonicalEvent struct {
+	EventId           string            `json:"eventId"`
+	EventType         string            `json:"eventType"`
+	EventData         string            `json:"eventData"`
+	EventVersion      int               `json:"eventVersion"`
+	EventTime         time.Time         `json:"eventTime"`
+	TenantId          string            `json:"tenantId,omitempty"`
+	SchemaVersion     int               `json:"schemaVersion,omitempty"`
+	AggregateId       string            `json:"aggregateId,omitempty"`
+	AggregateType     string            `json:"aggregateType,omitempty"`
+	AggregateSequence int               `json:"aggregateSequence,omitempty"`
+	CorrelationId     string            `json:"correlationId,omitempty"`
+	CausationId       string            `json:"causationId,omitempty"`
+	Actor             string            `json:"actor,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// CanonicalEventBytes returns the bytes that are hashed and signed: the JSON
+// encoding of the envelope fields listed in canonicalEvent.
+func CanonicalEventBytes(event Event) ([]byte, error) {
+	return json.Marshal(canonicalEvent{
+		EventId:           event.EventId,
+		EventType:         event.EventType,
+		EventData:         event.EventData,
+		EventVersion:      event.EventVersion,
+		EventTime:         event.EventTime,
+		TenantId:          event.TenantId,
+		SchemaVersion:     event.SchemaVersion,
+		AggregateId:       event.AggregateId,
+		AggregateType:     event.AggregateType,
+		AggregateSequence: event.AggregateSequence,
+		CorrelationId:     event.CorrelationId,
+		CausationId:       event.CausationId,
+		Actor:             event.Actor,
+		Metadata:          event.Metadata,
+	})
+}
+
+type Signer interface {
+	KeyId() string
+	Algorithm() string
+	Sign(data []byte) ([]byte, error)
+}
+
+type HMACSigner struct {
+	keyId string
+	key   []byte
+}
+
+func (s *HMACSigner) KeyId() string {
+	return s.keyId
+}
+
+func (s *HMACSigner) Algorithm() string {
+	return SignatureHMAC
+}
+
+func (s *HMACSigner) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func NewHMACSigner(keyId string, key []byte) *HMACSigner {
+	return &HMACSigner{keyId: keyId, key: key}
+}
+
+type Ed25519Signer struct {
+	keyId string
+	key   ed25519.PrivateKey
+}
+
+func (s *Ed25519Signer) KeyId() string {
+	return s.keyId
+}
+
+func (s *Ed25519Signer) Algorithm() string {
+	return SignatureEd25519
+}
+
+func (s *Ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, data), nil
+}
+
+func NewEd25519Signer(keyId string, key ed25519.PrivateKey) *Ed25519Signer {
+	return &Ed25519Signer{keyId: keyId, key: key}
+}
+
+// SignEvent fills in the EventSHA and, when signer is not nil, the signature
+// fields of event.
+func SignEvent(event *Event, signer Signer) error {
+	b, err := CanonicalEventBytes(*event)
+	if err != nil {
+		return err
+	}
+
+	event.EventSHA = fmt.Sprintf("%x", sha256.Sum256(b))
+
+	if signer == nil {
+		return nil
+	}
+
+	sig, err := signer.Sign(b)
+	if err != nil {
+		return err
+	}
+
+	event.Signature = base64.StdEncoding.EncodeToString(sig)
+	event.SignatureKeyId = signer.KeyId()
+	event.SignatureAlg = signer.Algorithm()
+	return nil
+}
+
+// TrustedKeys holds the keys of producers whose signatures are accepted.
+type TrustedKeys struct {
+	hmacKeys    map[string][]byte
+	ed25519Keys map[string]ed25519.PublicKey
+	mu          sync.RWMutex
+}
+
+func (tk *TrustedKeys) AddHMACKey(keyId string, key []byte) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.hmacKeys[keyId] = key
+}
+
+func (tk *TrustedKeys) AddEd25519Key(keyId string, key ed25519.PublicKey) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.ed25519Keys[keyId] = key
+}
+
+func (tk *TrustedKeys) verify(alg, keyId string, data, sig []byte) error {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	switch alg {
+	case SignatureHMAC:
+		key, ok := tk.hmacKeys[keyId]
+		if !ok {
+			return fmt.Errorf("unknown signing key %s", keyId)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("signature mismatch")
+		}
+	case SignatureEd25519:
+		key, ok := tk.ed25519Keys[keyId]
+		if !ok {
+			return fmt.Errorf("unknown signing key %s", keyId)
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return errors.New("signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	return nil
+}
+
+func NewTrustedKeys() *TrustedKeys {
+	return &TrustedKeys{
+		hmacKeys:    make(map[string][]byte),
+		ed25519Keys: make(map[string]ed25519.PublicKey),
+	}
+}
+
+type EventVerifier struct {
+	Policy VerifyPolicy
+	// Keys, when set, requires every event to carry a valid signature from
+	// one of the trusted keys.
+	Keys *TrustedKeys
+	// Quarantine receives events that fail verification under
+	// VerifyQuarantine.
+	Quarantine func(event Event, reason error)
+}
+
+func (v *EventVerifier) Verify(event Event) error {
+	if event.EventSHA == "" {
+		return fmt.Errorf("%w: event %s has no SHA", ErrEventIntegrity, event.EventId)
+	}
+
+	b, err := CanonicalEventBytes(event)
+	if err != nil {
+		return err
+	}
+
+	if fmt.Sprintf("%x", sha256.Sum256(b)) != event.EventSHA {
+		return fmt.Errorf("%w: SHA mismatch for event %s", ErrEventIntegrity, event.EventId)
+	}
+
+	if v.Keys == nil {
+		return nil
+	}
+
+	if event.Signature == "" {
+		return fmt.Errorf("%w: event %s is not signed", ErrEventIntegrity, event.EventId)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(event.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEventIntegrity, err)
+	}
+
+	if err := v.Keys.verify(event.SignatureAlg, event.SignatureKeyId, b, sig); err != nil {
+		return fmt.Errorf("%w: event %s: %v", ErrEventIntegrity, event.EventId, err)
+	}
+	return nil
+}
+
+// check applies the verifier's policy to event and reports whether the event
+// should be handled.
+func (v *EventVerifier) check(event Event) (bool, error) {
+	err := v.Verify(event)
+	if err == nil {
+		return true, nil
+	}
+
+	switch v.Policy {
+	case VerifyLog:
+		slog.Warn("EventVerifier", "Error", err, "EventId", event.EventId)
+		return true, nil
+	case VerifyQuarantine:
+		slog.Warn("EventVerifier", "Quarantined", event.EventId, "Error", err)
+		if v.Quarantine != nil {
+			v.Quarantine(event, err)
+		}
+		return false, nil
+	default:
+		slog.Error("EventVerifier", "Rejected", event.EventId, "Error", err)
+		return false, err
+	}
+}
@@ -0,0 +1,143 @@
+package common_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestEventSignatures(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+
+	keys := common.NewTrustedKeys()
+	keys.AddHMACKey("h1", []byte("shared"))
+	keys.AddEd25519Key("e1", pub)
+
+	verifier := &common.EventVerifier{Keys: keys}
+
+	signers := []common.Signer{
+		common.NewHMACSigner("h1", []byte("shared")),
+		common.NewEd25519Signer("e1", priv),
+	}
+
+	for _, signer := range signers {
+		ev := common.Event{EventId: common.NewEventId(), EventType: "testCreated", EventData: "{}", EventTime: time.Now()}
+
+		if err := common.SignEvent(&ev, signer); err != nil {
+			t.Fatalf("Error signing event: %v", err)
+		}
+
+		if err := verifier.Verify(ev); err != nil {
+			t.Errorf("%s: valid event failed verification: %v", signer.Algorithm(), err)
+		}
+
+		ev.EventData = `{"id":"2"}`
+		if err := verifier.Verify(ev); !errors.Is(err, common.ErrEventIntegrity) {
+			t.Errorf("%s: tampered event passed verification: %v", signer.Algorithm(), err)
+		}
+	}
+
+	ev := common.Event{EventId: "1"}
+	common.SignEvent(&ev, common.NewHMACSigner("h2", []byte("other")))
+
+	if err := verifier.Verify(ev); err == nil {
+		t.Errorf("Event signed with an untrusted key passed verification")
+	}
+}
+
+func TestHttpTransportSignsEvents(t *testing.T) {
+	var event common.Event
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&event)
+		w.WriteHeader(201)
+	}))
+	defer server.Close()
+
+	ht := common.NewHttpTransport(server.URL, "", 1)
+	ht.SetSigner(common.NewHMACSigner("h1", []byte("shared")))
+
+	err := ht.PostEvent(common.Event{EventId: "1", EventType: "test", EventTime: time.Now()})
+	if err != nil {
+		t.Fatalf("Error posting event: %v", err)
+	}
+
+	keys := common.NewTrustedKeys()
+	keys.AddHMACKey("h1", []byte("shared"))
+
+	verifier := &common.EventVerifier{Keys: keys}
+	if err := verifier.Verify(event); err != nil {
+		t.Errorf("Posted event failed verification: %v", err)
+	}
+}
+
+func TestEventServiceVerifyPolicy(t *testing.T) {
+	bad := common.Event{EventId: "1", EventType: "testCreated", EventData: `{"id":"1"}`, EventSHA: "bad"}
+
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	es := common.NewEventService(repo, &tenantTransport{}, "test")
+
+	es.SetVerifier(&common.EventVerifier{Policy: common.VerifyReject})
+	if err := es.HandleEvent(context.Background(), bad); !errors.Is(err, common.ErrEventIntegrity) {
+		t.Errorf("Rejected event should return an integrity error: %v", err)
+	}
+
+	var quarantined []common.Event
+	es.SetVerifier(&common.EventVerifier{
+		Policy: common.VerifyQuarantine,
+		Quarantine: func(event common.Event, reason error) {
+			quarantined = append(quarantined, event)
+		},
+	})
+	if err := es.HandleEvent(context.Background(), bad); err != nil {
+		t.Errorf("Quarantined event should not return an error: %v", err)
+	}
+
+	if len(quarantined) != 1 {
+		t.Errorf("Event was not quarantined")
+	}
+
+	ok, _ := es.Exists(context.Background(), "1")
+	if ok {
+		t.Errorf("Unverified event should not be applied")
+	}
+
+	es.SetVerifier(&common.EventVerifier{Policy: common.VerifyLog})
+	es.HandleEvent(context.Background(), bad)
+
+	ok, _ = es.Exists(context.Background(), "1")
+	if !ok {
+		t.Errorf("Event should be applied under the log policy")
+	}
+}
+
+func TestCanonicalEventBytesAreFixed(t *testing.T) {
+	ev := common.Event{
+		EventId:      "01H",
+		EventSHA:     "ignored",
+		EventType:    "choreCreated",
+		EventData:    "{}",
+		EventVersion: 1,
+		EventTime:    time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+		TenantId:     "acme",
+		Signature:    "ignored",
+	}
+
+	b, err := common.CanonicalEventBytes(ev)
+	if err != nil {
+		t.Fatalf("Error encoding event: %v", err)
+	}
+
+	// Consumers on any version must hash exactly these bytes.
+	want := `{"eventId":"01H","eventType":"choreCreated","eventData":"{}","eventVersion":1,"eventTime":"2024-03-04T09:00:00Z","tenantId":"acme"}`
+	if string(b) != want {
+		t.Errorf("Canonical bytes changed:\n got %s\nwant %s", b, want)
+	}
+}
@@ -3,14 +3,24 @@ package common
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/gob"
 	"errors"
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+const (
+	memcacheIndexId = "keys"
+	// memcacheTenantFlag marks items written for a tenant other than the
+	// default one. Keys in the default tenant are the bare ids, so the flag
+	// is what stops a default id containing ':' from reading or replacing a
+	// tenant's item with the same key. The rest of the flags hold the schema
+	// version.
+	memcacheTenantFlag uint32 = 1 << 31
+)
+
 type MemcacheClient interface {
 	Set(item *memcache.Item) error
 	Get(key string) (*memcache.Item, error)
@@ -18,47 +28,53 @@ type MemcacheClient interface {
 }
 
 type MemcacheRepository[T Entity[S], S string] struct {
-	client MemcacheClient
-	host   string
-	prefix string
+	client  MemcacheClient
+	host    string
+	prefix  string
+	codec   Codec
+	schemas *SchemaRegistry
 }
 
 func (mr MemcacheRepository[T, S]) Create(ctx context.Context, e T) error {
 
 	id := e.GetID()
 
-	if _, err := mr.Get(ctx, id); err == nil {
+	if string(id) == memcacheIndexId {
+		return fmt.Errorf("%q is reserved for the key index", id)
+	}
+
+	defer mr.lockIndex(ctx)()
+
+	// Any item at the key makes it unusable, even one another tenant owns.
+	if item, err := mr.client.Get(mr.prefix + storageKey(ctx, string(id))); err == nil && item != nil {
 		return errors.New("entity already exists")
 	}
 
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
+	keys, _ := mr.client.Get(mr.indexKey(ctx))
+	if keys != nil && !mr.owns(ctx, keys) {
+		return fmt.Errorf("key index %s is in use by another tenant", mr.indexKey(ctx))
+	}
 
-	err := enc.Encode(e)
+	value, err := mr.codec.Marshal(e)
 	if err != nil {
 		return err
 	}
 
-	h := sha256.New()
-
-	h.Write(b.Bytes())
 	err = mr.client.Set(&memcache.Item{
-		Key:   mr.prefix + string(id),
-		Value: b.Bytes(),
-		Flags: 0,
+		Key:   mr.prefix + storageKey(ctx, string(id)),
+		Value: value,
+		Flags: mr.flags(ctx, mr.schemaVersion()),
 	})
 	if err != nil {
 		return err
 	}
 
-	keys, _ := mr.client.Get(mr.prefix + "keys")
-
 	str := string(id) + ","
 	if keys == nil {
 		keys = &memcache.Item{
-			Key:   mr.prefix + "keys",
+			Key:   mr.indexKey(ctx),
 			Value: []byte(str),
-			Flags: 0,
+			Flags: mr.flags(ctx, 0),
 		}
 	} else {
 		keys.Value = append(keys.Value, []byte(str)...)
@@ -80,15 +96,14 @@ func (mr *MemcacheRepository[T, S]) Save(ctx context.Context, e T) error {
 		return errors.New("entity not found")
 	}
 
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	err := enc.Encode(e)
+	value, err := mr.codec.Marshal(e)
 	if err != nil {
 		return err
 	}
 	mr.client.Set(&memcache.Item{
-		Key:   mr.prefix + string(id),
-		Value: b.Bytes(),
+		Key:   mr.prefix + storageKey(ctx, string(id)),
+		Value: value,
+		Flags: mr.flags(ctx, mr.schemaVersion()),
 	})
 	return nil
 }
@@ -97,18 +112,25 @@ func (mr *MemcacheRepository[T, S]) Get(ctx context.Context, id S) (T, error) {
 
 	var entity T
 
-	item, err := mr.client.Get(mr.prefix + string(id))
+	item, err := mr.client.Get(mr.prefix + storageKey(ctx, string(id)))
 	if err != nil {
 
 		return entity, err
 	}
 
-	if item == nil {
+	if item == nil || !mr.owns(ctx, item) {
 		return entity, errors.New("entity not found")
 	}
 
-	dec := gob.NewDecoder(bytes.NewReader(item.Value))
-	err = dec.Decode(&entity)
+	value := item.Value
+	if mr.schemas != nil {
+		value, err = mr.schemas.Upcast(mr.prefix, int(item.Flags&^memcacheTenantFlag), mr.codec, value)
+		if err != nil {
+			return entity, err
+		}
+	}
+
+	err = mr.codec.Unmarshal(value, &entity)
 	if err != nil {
 		return entity, err
 	}
@@ -116,9 +138,9 @@ func (mr *MemcacheRepository[T, S]) Get(ctx context.Context, id S) (T, error) {
 	return entity, nil
 }
 func (mr *MemcacheRepository[T, S]) GetAll(ctx context.Context) ([]T, error) {
-	keys, _ := mr.client.Get(mr.prefix + "keys")
+	keys, _ := mr.client.Get(mr.indexKey(ctx))
 
-	if keys == nil {
+	if keys == nil || !mr.owns(ctx, keys) {
 		return nil, nil
 	}
 
@@ -126,6 +148,9 @@ func (mr *MemcacheRepository[T, S]) GetAll(ctx context.Context) ([]T, error) {
 	entities := []T{}
 
 	for _, id := range ids {
+		if len(id) == 0 {
+			continue
+		}
 		e, err := mr.Get(ctx, S(id))
 		if err != nil {
 			return nil, err
@@ -140,11 +165,16 @@ func (mr *MemcacheRepository[T, S]) Delete(ctx context.Context, e T) error {
 		return err
 	}
 
-	mr.client.Delete(mr.prefix + string(id))
+	defer mr.lockIndex(ctx)()
 
-	keys, _ := mr.client.Get(mr.prefix + "keys")
+	// The key may hold another tenant's item, which is left alone.
+	if ok, _ := mr.Exists(ctx, id); ok {
+		mr.client.Delete(mr.prefix + storageKey(ctx, string(id)))
+	}
 
-	if keys == nil {
+	keys, _ := mr.client.Get(mr.indexKey(ctx))
+
+	if keys == nil || !mr.owns(ctx, keys) {
 		return nil
 	}
 
@@ -185,6 +215,58 @@ func (mr *MemcacheRepository[T, S]) GetClient() MemcacheClient {
 	return mr.client
 }
 
+func (mr *MemcacheRepository[T, S]) SetCodec(codec Codec) error {
+	mr.codec = codec
+	return nil
+}
+
+func (mr *MemcacheRepository[T, S]) SetSchemaRegistry(schemas *SchemaRegistry) error {
+	mr.schemas = schemas
+	return nil
+}
+
+// indexKey is the key of the list of the tenant's ids. It is named like an
+// entity, so Create rejects that id.
+func (mr *MemcacheRepository[T, S]) indexKey(ctx context.Context) string {
+	return mr.prefix + storageKey(ctx, memcacheIndexId)
+}
+
+// memcacheIndexLocks holds a mutex per key index. Create and Delete read,
+// change and write the index, so concurrent calls, such as event handlers on
+// several workers, would otherwise lose each other's ids. This only covers
+// repositories in the same process.
+var memcacheIndexLocks sync.Map
+
+// lockIndex locks the tenant's key index and returns the func to unlock it.
+func (mr *MemcacheRepository[T, S]) lockIndex(ctx context.Context) func() {
+	mu, _ := memcacheIndexLocks.LoadOrStore(mr.indexKey(ctx), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// flags returns the item flags for version in the tenant from ctx.
+func (mr *MemcacheRepository[T, S]) flags(ctx context.Context, version uint32) uint32 {
+	if TenantFromContext(ctx) != "" {
+		version |= memcacheTenantFlag
+	}
+	return version
+}
+
+// owns reports whether item was written for the tenant from ctx, or for the
+// default tenant when ctx has none.
+func (mr *MemcacheRepository[T, S]) owns(ctx context.Context, item *memcache.Item) bool {
+	return (item.Flags&memcacheTenantFlag != 0) == (TenantFromContext(ctx) != "")
+}
+
+// schemaVersion is stored in the item flags so reads know which upcasters to
+// run. Items written before schemas were tracked have flags 0.
+func (mr *MemcacheRepository[T, S]) schemaVersion() uint32 {
+	if mr.schemas == nil {
+		return 0
+	}
+	return uint32(mr.schemas.CurrentVersion(mr.prefix))
+}
+
 func NewMemcacheRepository[T Entity[S], S string](host string, prefix string, mc MemcacheClient) Repository[T, S] {
 	if mc == nil {
 		mc = memcache.New(host)
@@ -193,5 +275,6 @@ func NewMemcacheRepository[T Entity[S], S string](host string, prefix string, mc
 		client: mc,
 		host:   host,
 		prefix: prefix,
+		codec:  GobCodec{},
 	}
 }
@@ -3,7 +3,10 @@ package common_test
 import (
 	"context"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	common "github.com/papawattu/cleanlog-common"
@@ -166,3 +169,58 @@ func TestMemcacheRepositoryWithRealMemcache(t *testing.T) {
 		t.Errorf("Error getting entity id: %v", err)
 	}
 }
+
+// slowMemcacheClient is safe for concurrent use and slow enough for
+// concurrent read-modify-writes to overlap.
+type slowMemcacheClient struct {
+	mu    sync.Mutex
+	store map[string]memcache.Item
+}
+
+func (m *slowMemcacheClient) Set(item *memcache.Item) error {
+	time.Sleep(time.Millisecond)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *item
+	stored.Value = append([]byte(nil), item.Value...)
+	m.store[item.Key] = stored
+	return nil
+}
+
+func (m *slowMemcacheClient) Get(key string) (*memcache.Item, error) {
+	time.Sleep(time.Millisecond)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.store[key]
+	if !ok {
+		return nil, nil
+	}
+	item.Value = append([]byte(nil), item.Value...)
+	return &item, nil
+}
+
+func (m *slowMemcacheClient) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.store, key)
+	return nil
+}
+
+func TestMemcacheRepositoryConcurrentCreate(t *testing.T) {
+	mr := common.NewMemcacheRepository[*common.BaseEntity[string]]("", "test", &slowMemcacheClient{store: make(map[string]memcache.Item)})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mr.Create(ctx, &common.BaseEntity[string]{ID: strconv.Itoa(i)})
+		}()
+	}
+	wg.Wait()
+
+	if all, _ := mr.GetAll(ctx); len(all) != 20 {
+		t.Errorf("Concurrent creates lost ids from the key index: %d", len(all))
+	}
+}
@@ -56,6 +56,11 @@ func Recover(next http.Handler) http.Handler {
 	})
 }
 
+func UserFromContext(ctx context.Context) (int, bool) {
+	userId, ok := ctx.Value("user").(int)
+	return userId, ok
+}
+
 func Authenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
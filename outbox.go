@@ -0,0 +1,332 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+var ErrOutboxEntryNotFound = errors.New("outbox entry not found")
+
+const (
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxMaxAttempts  = 20
+	// outboxHoldTimeout is how long an entry recorded ahead of a local change
+	// waits to be released before it is published anyway.
+	outboxHoldTimeout = 30 * time.Second
+)
+
+// OutboxEntry is an event waiting to be published, or one that failed to
+// be if FailedAt is set. Its id is the event id. Entries are deleted once
+// they are published.
+type OutboxEntry struct {
+	BaseEntity[string]
+	Event         Event     `json:"event"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	FailedAt      time.Time `json:"failedAt"`
+}
+
+// Outbox records events in a repository before they are published, and
+// relays them through a transport until they are. Events are published at
+// least once, in the order of their ids, which is the order they were
+// created in. Entries are kept in the default tenant; the event itself
+// carries its tenant.
+//
+// The outbox and the entity repository are separate stores, so there is no
+// transaction spanning both. Instead the entry is always written first: in
+// eventual and await modes it is the only write, and in local-apply mode it
+// is held until the local change is made, then released. If the process
+// dies in between, the held entry is published when the hold expires and
+// the service applies the event when it comes back, so a change is never
+// kept without its event.
+//
+// An entry that still fails after the maximum number of attempts is marked
+// failed and set aside, so it stops holding back the entries after it. It
+// stays in the outbox until it is requeued or discarded.
+type Outbox struct {
+	repo         Repository[*OutboxEntry, string]
+	transport    Transport
+	backoff      func(attempt int) time.Duration
+	maxAttempts  int
+	pollInterval time.Duration
+	added        chan struct{}
+}
+
+// SetRetryBackoff sets how long to wait before publishing an entry again
+// after attempt failures. The default doubles from 1 second up to 30.
+func (o *Outbox) SetRetryBackoff(backoff func(attempt int) time.Duration) {
+	o.backoff = backoff
+}
+
+// SetMaxAttempts sets how often an entry is published before it is marked
+// failed. The default is 20.
+func (o *Outbox) SetMaxAttempts(attempts int) {
+	if attempts <= 0 {
+		attempts = defaultOutboxMaxAttempts
+	}
+	o.maxAttempts = attempts
+}
+
+// SetPollInterval sets how often Run looks for entries that are due when it
+// has not been told about a new one.
+func (o *Outbox) SetPollInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultOutboxPollInterval
+	}
+	o.pollInterval = interval
+}
+
+// Add records event to be published.
+func (o *Outbox) Add(ctx context.Context, event Event) error {
+	_, err := o.add(ctx, event, time.Now())
+	return err
+}
+
+func (o *Outbox) add(ctx context.Context, event Event, publishAt time.Time) (*OutboxEntry, error) {
+	if event.EventId == "" {
+		event.EventId = NewEventId()
+	}
+
+	now := time.Now()
+	entry := &OutboxEntry{
+		BaseEntity:    BaseEntity[string]{ID: event.EventId, CreationDate: now, LastUpdateDate: now, Version: 1},
+		Event:         event,
+		NextAttemptAt: publishAt,
+	}
+	if err := o.repo.Create(o.context(ctx), entry); err != nil {
+		return nil, fmt.Errorf("adding event %s to outbox: %w", event.EventId, err)
+	}
+
+	o.notify()
+	return entry, nil
+}
+
+// hold records event ahead of the change it describes. It is not published
+// until it is released or the hold expires. Entries after it wait too, so
+// events stay in order.
+func (o *Outbox) hold(ctx context.Context, event Event) (*OutboxEntry, error) {
+	return o.add(ctx, event, time.Now().Add(outboxHoldTimeout))
+}
+
+// release lets a held entry be published straight away.
+func (o *Outbox) release(ctx context.Context, entry *OutboxEntry) error {
+	entry.NextAttemptAt = time.Now()
+	entry.LastUpdateDate = entry.NextAttemptAt
+	if err := o.repo.Save(o.context(ctx), entry); err != nil {
+		return fmt.Errorf("releasing outbox entry %s: %w", entry.ID, err)
+	}
+
+	o.notify()
+	return nil
+}
+
+// discard removes a held entry whose change was not made.
+func (o *Outbox) discard(ctx context.Context, entry *OutboxEntry) error {
+	if err := o.repo.Delete(o.context(ctx), entry); err != nil {
+		return fmt.Errorf("discarding outbox entry %s: %w", entry.ID, err)
+	}
+	return nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the entries that have not been published yet and have not
+// failed, oldest first.
+func (o *Outbox) Pending(ctx context.Context) ([]*OutboxEntry, error) {
+	return o.entries(ctx, func(entry *OutboxEntry) bool { return entry.FailedAt.IsZero() })
+}
+
+// Failed returns the entries that ran out of attempts, oldest first.
+func (o *Outbox) Failed(ctx context.Context) ([]*OutboxEntry, error) {
+	return o.entries(ctx, func(entry *OutboxEntry) bool { return !entry.FailedAt.IsZero() })
+}
+
+// Requeue gives a failed entry a fresh set of attempts, starting now.
+func (o *Outbox) Requeue(ctx context.Context, id string) error {
+	entry, err := o.get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	entry.Attempts = 0
+	entry.FailedAt = time.Time{}
+	entry.NextAttemptAt = time.Now()
+	entry.LastUpdateDate = entry.NextAttemptAt
+	if err := o.repo.Save(o.context(ctx), entry); err != nil {
+		return fmt.Errorf("requeueing outbox entry %s: %w", id, err)
+	}
+
+	o.notify()
+	return nil
+}
+
+// Discard removes an entry without publishing it.
+func (o *Outbox) Discard(ctx context.Context, id string) error {
+	entry, err := o.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return o.discard(ctx, entry)
+}
+
+// Flush publishes the pending entries that are due and returns how many it
+// published. It stops at the first entry that fails, so later events are not
+// published ahead of it, unless that was its last attempt and it is marked
+// failed. It also stops when ctx is done; transports with a
+// PostEventContext method are given ctx, so a slow post can be cancelled
+// too.
+func (o *Outbox) Flush(ctx context.Context) (int, error) {
+	pending, err := o.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, entry := range pending {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		if time.Now().Before(entry.NextAttemptAt) {
+			break
+		}
+
+		err := o.post(ctx, entry.Event)
+
+		// An attempt abandoned because ctx is done does not count.
+		if err != nil && ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		if err != nil {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			entry.LastUpdateDate = time.Now()
+			entry.NextAttemptAt = entry.LastUpdateDate.Add(o.retryBackoff(entry.Attempts))
+			if entry.Attempts >= o.maxAttempts {
+				entry.FailedAt = entry.LastUpdateDate
+			}
+			if saveErr := o.repo.Save(o.context(ctx), entry); saveErr != nil {
+				slog.Error("Error updating outbox entry", "EventId", entry.ID, "error", saveErr)
+			}
+			if !entry.FailedAt.IsZero() {
+				slog.Error("Outbox entry failed", "EventId", entry.ID, "attempts", entry.Attempts, "error", err)
+				continue
+			}
+			return sent, fmt.Errorf("publishing event %s: %w", entry.ID, err)
+		}
+
+		// A crash before this delete means the event is published again.
+		if err := o.repo.Delete(o.context(ctx), entry); err != nil {
+			return sent, fmt.Errorf("removing sent event %s: %w", entry.ID, err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Run relays pending entries until ctx is done. Entries are published as
+// soon as they are added and failures are retried with backoff.
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		if _, err := o.Flush(ctx); err != nil {
+			slog.Error("Outbox relay error", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.added:
+		case <-time.After(o.pollInterval):
+		}
+	}
+}
+
+func (o *Outbox) post(ctx context.Context, event Event) error {
+	if t, ok := o.transport.(interface {
+		PostEventContext(ctx context.Context, event Event) error
+	}); ok {
+		return t.PostEventContext(ctx, event)
+	}
+	return o.transport.PostEvent(event)
+}
+
+// entries returns the entries keep is true for, oldest first.
+func (o *Outbox) entries(ctx context.Context, keep func(*OutboxEntry) bool) ([]*OutboxEntry, error) {
+	all, err := o.repo.GetAll(o.context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*OutboxEntry{}
+	for _, entry := range all {
+		if keep(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (o *Outbox) get(ctx context.Context, id string) (*OutboxEntry, error) {
+	entry, err := o.repo.Get(o.context(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%w: %s", ErrOutboxEntryNotFound, id)
+	}
+	return entry, nil
+}
+
+func (o *Outbox) retryBackoff(attempt int) time.Duration {
+	if o.backoff != nil {
+		return o.backoff(attempt)
+	}
+	return min(backoff(attempt-1), maxReconnectBackoff)
+}
+
+func (o *Outbox) context(ctx context.Context) context.Context {
+	return WithTenant(ctx, "")
+}
+
+// NewOutbox returns an outbox that keeps entries in repo and publishes them
+// through transport.
+func NewOutbox(repo Repository[*OutboxEntry, string], transport Transport) *Outbox {
+	return &Outbox{
+		repo:         repo,
+		transport:    transport,
+		maxAttempts:  defaultOutboxMaxAttempts,
+		pollInterval: defaultOutboxPollInterval,
+		added:        make(chan struct{}, 1),
+	}
+}
+
+// SetOutbox makes Create, Save and Delete record their events in outbox
+// instead of posting them. The outbox's Run must be running to publish them.
+// In local-apply mode the event is recorded before the local change, so use
+// a persistent dedup store if the echo of a change made just before a crash
+// must be skipped rather than fail.
+func (es *EventServiceImpl[T, S]) SetOutbox(outbox *Outbox) {
+	es.outbox = outbox
+}
+
+// send posts event, or adds it to the outbox if there is one.
+func (es *EventServiceImpl[T, S]) send(ctx context.Context, event Event) error {
+	if es.outbox != nil {
+		return es.outbox.Add(ctx, event)
+	}
+	return es.PostEvent(event)
+}
@@ -0,0 +1,208 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type flakyTransport struct {
+	tenantTransport
+	mu       sync.Mutex
+	failures int
+}
+
+func (t *flakyTransport) PostEvent(e common.Event) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failures > 0 {
+		t.failures--
+		return errors.New("connection refused")
+	}
+	return t.tenantTransport.PostEvent(e)
+}
+
+func (t *flakyTransport) posted() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.events)
+}
+
+func TestOutbox(t *testing.T) {
+	trans := &flakyTransport{failures: 1}
+	outbox := common.NewOutbox(common.NewInMemoryRepository[*common.OutboxEntry](), trans)
+	outbox.SetRetryBackoff(func(attempt int) time.Duration { return 0 })
+
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	es.SetOutbox(outbox)
+
+	ctx := common.WithTenant(context.Background(), "acme")
+
+	if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+	es.Create(ctx, &common.BaseEntity[string]{ID: "2"})
+
+	if trans.posted() != 0 {
+		t.Errorf("Events should wait in the outbox")
+	}
+
+	if _, err := outbox.Flush(context.Background()); err == nil {
+		t.Errorf("Failed post should be returned")
+	}
+
+	pending, _ := outbox.Pending(context.Background())
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("Failed entry should stay pending: %+v", pending)
+	}
+
+	sent, err := outbox.Flush(context.Background())
+	if err != nil || sent != 2 {
+		t.Fatalf("Pending entries were not published: %d %v", sent, err)
+	}
+
+	if trans.events[0].AggregateId != "1" || trans.events[0].TenantId != "acme" {
+		t.Errorf("Events were not published in order: %+v", trans.events)
+	}
+
+	if pending, _ := outbox.Pending(context.Background()); len(pending) != 0 {
+		t.Errorf("Sent entries should be removed: %d left", len(pending))
+	}
+}
+
+func TestOutboxFailedEntries(t *testing.T) {
+	trans := &flakyTransport{failures: 2}
+	outbox := common.NewOutbox(common.NewInMemoryRepository[*common.OutboxEntry](), trans)
+	outbox.SetRetryBackoff(func(attempt int) time.Duration { return 0 })
+	outbox.SetMaxAttempts(2)
+
+	ctx := context.Background()
+	outbox.Add(ctx, common.Event{EventId: "1", EventType: "testCreated"})
+	outbox.Add(ctx, common.Event{EventId: "2", EventType: "testCreated"})
+
+	outbox.Flush(ctx)
+
+	// The second failure is the last attempt, so the entry is set aside and
+	// the one after it is published.
+	sent, err := outbox.Flush(ctx)
+	if err != nil || sent != 1 || trans.events[0].EventId != "2" {
+		t.Fatalf("Failed entry should not hold back the next one: %d %v", sent, err)
+	}
+
+	failed, _ := outbox.Failed(ctx)
+	if len(failed) != 1 || failed[0].ID != "1" || failed[0].Attempts != 2 {
+		t.Fatalf("Entry should be marked failed: %+v", failed)
+	}
+	if pending, _ := outbox.Pending(ctx); len(pending) != 0 {
+		t.Errorf("Failed entry should not be pending: %d", len(pending))
+	}
+
+	if err := outbox.Requeue(ctx, "1"); err != nil {
+		t.Fatalf("Error requeueing entry: %v", err)
+	}
+	if sent, err := outbox.Flush(ctx); err != nil || sent != 1 {
+		t.Errorf("Requeued entry was not published: %d %v", sent, err)
+	}
+
+	if err := outbox.Discard(ctx, "1"); !errors.Is(err, common.ErrOutboxEntryNotFound) {
+		t.Errorf("Published entry should be gone: %v", err)
+	}
+}
+
+func TestOutboxFlushCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	outbox := common.NewOutbox(common.NewInMemoryRepository[*common.OutboxEntry](), common.NewHttpTransport(server.URL, "", 0))
+	outbox.Add(context.Background(), common.Event{EventType: "testCreated"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := outbox.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush should stop when ctx is done: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Flush waited out the transport's retries: %s", time.Since(start))
+	}
+
+	pending, _ := outbox.Pending(context.Background())
+	if len(pending) != 1 || pending[0].Attempts != 0 {
+		t.Errorf("Cancelled attempt should not count: %+v", pending)
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	trans := &flakyTransport{}
+	outbox := common.NewOutbox(common.NewInMemoryRepository[*common.OutboxEntry](), trans)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go outbox.Run(ctx)
+
+	outbox.Add(context.Background(), common.Event{EventType: "testCreated"})
+
+	waitFor(t, "event to be relayed", func() bool { return trans.posted() == 1 })
+}
+
+func TestOutboxLocalApply(t *testing.T) {
+	trans := &flakyTransport{}
+	outbox := common.NewOutbox(common.NewInMemoryRepository[*common.OutboxEntry](), trans)
+
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	es.SetConsistency(common.ConsistencyLocalApply, 0)
+	es.SetOutbox(outbox)
+
+	applying := make(chan struct{})
+	resume := make(chan struct{})
+	var once sync.Once
+	es.Subscribe("*", func(ctx context.Context, event common.Event) error {
+		once.Do(func() {
+			close(applying)
+			<-resume
+		})
+		return nil
+	})
+
+	ctx := context.Background()
+
+	created := make(chan error, 1)
+	go func() {
+		created <- es.Create(ctx, &common.BaseEntity[string]{ID: "1"})
+	}()
+
+	<-applying
+	pending, _ := outbox.Pending(ctx)
+	if len(pending) != 1 {
+		t.Errorf("Event should be recorded before the change is made: %d", len(pending))
+	}
+	if sent, _ := outbox.Flush(ctx); sent != 0 {
+		t.Errorf("Event should not be published while the change is being made")
+	}
+
+	close(resume)
+	if err := <-created; err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	if sent, err := outbox.Flush(ctx); err != nil || sent != 1 {
+		t.Errorf("Event should be published once the change is made: %d %v", sent, err)
+	}
+
+	if err := es.Create(ctx, &common.BaseEntity[string]{ID: "1"}); err == nil {
+		t.Fatal("Creating an existing entity should fail")
+	}
+	if pending, _ := outbox.Pending(ctx); len(pending) != 0 {
+		t.Errorf("Failed change should leave no outbox entry: %d", len(pending))
+	}
+}
@@ -0,0 +1,354 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultProjectionPollInterval = 100 * time.Millisecond
+	projectionBatchSize           = 100
+)
+
+// ErrNoEventLog is returned by the projection methods that need an event log
+// when the projection only follows a transport.
+var ErrNoEventLog = errors.New("projection has no event log")
+
+// Projection builds a read model from an event log, with Run, or from the
+// events on a transport, with RunStream. Handlers are added with Subscribe or
+// On and usually write to ReadModel. The projection saves the position it
+// has reached under its name, so it carries on from there when it is run
+// again.
+type Projection[T Entity[S], S comparable] struct {
+	name          string
+	log           EventLog
+	readModel     Repository[T, S]
+	checkpoints   CheckpointStore
+	subscriptions []subscription
+	codec         Codec
+	retryPolicy   RetryPolicy
+	pollInterval  time.Duration
+
+	// mu is held while events are applied, so Run and Rebuild take turns.
+	mu       sync.Mutex
+	position atomic.Uint64
+	paused   atomic.Bool
+	resumed  chan struct{}
+}
+
+func (p *Projection[T, S]) Name() string {
+	return p.name
+}
+
+func (p *Projection[T, S]) ReadModel() Repository[T, S] {
+	return p.readModel
+}
+
+// Subscribe adds a handler for every event type matching pattern, with the
+// same patterns as EventServiceImpl.Subscribe.
+func (p *Projection[T, S]) Subscribe(pattern string, handler EventHandler) {
+	p.subscriptions = append(p.subscriptions, subscription{pattern: pattern, handler: handler})
+}
+
+// SetEventCodec sets the codec On decodes payloads with. The default is JSON.
+func (p *Projection[T, S]) SetEventCodec(codec Codec) {
+	p.codec = codec
+}
+
+func (p *Projection[T, S]) EventCodec() Codec {
+	if p.codec == nil {
+		return JSONCodec{}
+	}
+	return p.codec
+}
+
+// SetRetryPolicy sets how often a failing event is retried before Run gives
+// up and returns the error.
+func (p *Projection[T, S]) SetRetryPolicy(policy RetryPolicy) {
+	p.retryPolicy = policy
+}
+
+// SetPollInterval sets how often Run checks the log for new events once it
+// has caught up.
+func (p *Projection[T, S]) SetPollInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultProjectionPollInterval
+	}
+	p.pollInterval = interval
+}
+
+// Position returns the position of the last event applied.
+func (p *Projection[T, S]) Position() uint64 {
+	return p.position.Load()
+}
+
+// Lag returns how many events in the log have not been applied yet.
+func (p *Projection[T, S]) Lag(ctx context.Context) (uint64, error) {
+	if p.log == nil {
+		return 0, ErrNoEventLog
+	}
+
+	head, err := p.log.Head(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return head - min(head, p.Position()), nil
+}
+
+// Pause stops Run applying events after the current batch.
+func (p *Projection[T, S]) Pause() {
+	p.paused.Store(true)
+}
+
+func (p *Projection[T, S]) Resume() {
+	if p.paused.CompareAndSwap(true, false) {
+		select {
+		case p.resumed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *Projection[T, S]) Paused() bool {
+	return p.paused.Load()
+}
+
+// Run applies events from the saved position onwards and then follows the
+// log until ctx is done. It returns an error if an event still fails after
+// retrying, leaving the position at the event before it.
+func (p *Projection[T, S]) Run(ctx context.Context) error {
+	if p.log == nil {
+		return ErrNoEventLog
+	}
+
+	if err := p.loadPosition(ctx); err != nil {
+		return err
+	}
+
+	for {
+		if p.Paused() {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-p.resumed:
+			}
+			continue
+		}
+
+		applied, err := p.applyBatch(ctx)
+		if err != nil {
+			return err
+		}
+
+		if applied > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.resumed:
+		case <-time.After(p.pollInterval):
+		}
+	}
+}
+
+// Rebuild clears the read model and applies the whole log again. The read
+// model is cleared one tenant at a time, when the first event for the tenant
+// is replayed. Run, if it is running, waits until the rebuild is done.
+func (p *Projection[T, S]) Rebuild(ctx context.Context) error {
+	if p.log == nil {
+		return ErrNoEventLog
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.position.Store(0)
+
+	cleared := map[string]bool{}
+	for {
+		events, err := p.log.ReadAll(ctx, p.Position(), projectionBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return p.savePosition(ctx)
+		}
+
+		for _, event := range events {
+			if !cleared[event.Event.TenantId] {
+				if err := p.clearTenant(WithTenant(ctx, event.Event.TenantId)); err != nil {
+					return err
+				}
+				cleared[event.Event.TenantId] = true
+			}
+
+			if err := p.apply(ctx, event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RunStream applies the events on transport until ctx is done, using an event
+// runner of its own that reconnects and retries like the service's. The
+// runner checkpoints under the projection's name, separately from any other
+// consumer of the stream, so the projection carries on from there when it is
+// run again. RunStream returns an error if an event still fails after
+// retrying, leaving the checkpoint at the event before it. Position and Lag
+// only apply to Run.
+func (p *Projection[T, S]) RunStream(ctx context.Context, transport Transport) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runner := NewEventService(p.readModel, transport, p.name)
+	runner.SetHandlers(EventHandlers{})
+	runner.SetEventCodec(p.EventCodec())
+	runner.SetRetryPolicy(p.retryPolicy)
+	runner.SetCheckpointStore(p.checkpoints, p.checkpointName()+":stream", 1)
+
+	var failed error
+	var once sync.Once
+	runner.SetErrorHandler(func(err error, event *Event) {
+		if event == nil {
+			slog.Error("Projection stream error", "projection", p.name, "error", err)
+			return
+		}
+		once.Do(func() {
+			failed = fmt.Errorf("projection %s: event %s: %w", p.name, event.EventId, err)
+			cancel()
+		})
+	})
+
+	runner.Subscribe("*", func(ctx context.Context, event Event) error {
+		if err := p.waitWhilePaused(ctx); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.dispatch(ctx, event)
+	})
+
+	err := runner.StartEventRunner(ctx).Wait()
+	return errors.Join(failed, err)
+}
+
+// waitWhilePaused blocks until the projection is resumed or ctx is done.
+func (p *Projection[T, S]) waitWhilePaused(ctx context.Context) error {
+	for p.Paused() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.resumed:
+		}
+	}
+	return nil
+}
+
+// applyBatch applies the next batch of events and returns how many it
+// applied.
+func (p *Projection[T, S]) applyBatch(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	events, err := p.log.ReadAll(ctx, p.Position(), projectionBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, event := range events {
+		if err := p.apply(ctx, event); err != nil {
+			return i, errors.Join(err, p.savePosition(ctx))
+		}
+	}
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return len(events), p.savePosition(ctx)
+}
+
+func (p *Projection[T, S]) apply(ctx context.Context, stored StoredEvent) error {
+	event := stored.Event
+	handlerCtx := EventContext(ctx, event)
+
+	_, err := retry(ctx, p.retryPolicy, func() error {
+		return p.dispatch(handlerCtx, event)
+	})
+	if err != nil {
+		return fmt.Errorf("projection %s: event %d: %w", p.name, stored.Position, err)
+	}
+
+	p.position.Store(stored.Position)
+	return nil
+}
+
+// dispatch runs the handlers matching event.
+func (p *Projection[T, S]) dispatch(ctx context.Context, event Event) error {
+	var errs []error
+	for _, s := range p.subscriptions {
+		if s.matches(event.EventType) {
+			errs = append(errs, s.handler(ctx, event))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// clearTenant deletes the read model's entities for the tenant in ctx.
+func (p *Projection[T, S]) clearTenant(ctx context.Context) error {
+	all, err := p.readModel.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range all {
+		if err := p.readModel.Delete(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Projection[T, S]) loadPosition(ctx context.Context) error {
+	saved, err := p.checkpoints.Load(ctx, p.checkpointName())
+	if err != nil || saved == "" {
+		return err
+	}
+
+	position, err := strconv.ParseUint(saved, 10, 64)
+	if err != nil {
+		return fmt.Errorf("projection %s: bad checkpoint %q: %w", p.name, saved, err)
+	}
+
+	p.position.Store(position)
+	return nil
+}
+
+func (p *Projection[T, S]) savePosition(ctx context.Context) error {
+	return p.checkpoints.Save(ctx, p.checkpointName(), strconv.FormatUint(p.Position(), 10))
+}
+
+func (p *Projection[T, S]) checkpointName() string {
+	return "projection:" + p.name
+}
+
+// NewProjection returns a projection called name that reads log into
+// readModel and saves its position in checkpoints. log may be nil for a
+// projection that only runs with RunStream.
+func NewProjection[T Entity[S], S comparable](name string, log EventLog, readModel Repository[T, S], checkpoints CheckpointStore) *Projection[T, S] {
+	return &Projection[T, S]{
+		name:         name,
+		log:          log,
+		readModel:    readModel,
+		checkpoints:  checkpoints,
+		pollInterval: defaultProjectionPollInterval,
+		resumed:      make(chan struct{}, 1),
+	}
+}
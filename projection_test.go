@@ -0,0 +1,167 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type WeeklyHours struct {
+	common.BaseEntity[string]
+	Hours int
+}
+
+type LogHours struct {
+	Hours int `json:"hours"`
+}
+
+func appendLog(store *common.InMemoryEventStore, id, actor string, hours int, at time.Time) {
+	store.Append(context.Background(), id, common.AnyVersion, []common.Event{{
+		EventType: "logCreated",
+		EventData: fmt.Sprintf(`{"hours":%d}`, hours),
+		EventTime: at,
+		Actor:     actor,
+	}})
+}
+
+func weeklyHoursProjection(log common.EventLog, checkpoints common.CheckpointStore) *common.Projection[*WeeklyHours, string] {
+	p := common.NewProjection("weeklyHours", log, common.NewInMemoryRepository[*WeeklyHours](), checkpoints)
+	p.SetPollInterval(5 * time.Millisecond)
+
+	common.On(p, "log*", func(ctx context.Context, payload LogHours, event common.Event) error {
+		year, week := event.EventTime.ISOWeek()
+		id := fmt.Sprintf("%s:%d-%d", event.Actor, year, week)
+
+		w, err := p.ReadModel().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if w == nil {
+			return p.ReadModel().Create(ctx, &WeeklyHours{BaseEntity: common.BaseEntity[string]{ID: id}, Hours: payload.Hours})
+		}
+		w.Hours += payload.Hours
+		return p.ReadModel().Save(ctx, w)
+	})
+	return p
+}
+
+func TestProjection(t *testing.T) {
+	store := common.NewInMemoryEventStore()
+	checkpoints := common.NewInMemoryCheckpointStore()
+
+	monday := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	appendLog(store, "1", "alice", 2, monday)
+	appendLog(store, "2", "alice", 3, monday.Add(24*time.Hour))
+	appendLog(store, "3", "alice", 1, monday.Add(7*24*time.Hour))
+
+	p := weeklyHoursProjection(store, checkpoints)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go p.Run(ctx)
+
+	waitFor(t, "projection to catch up", func() bool { return p.Position() == 3 })
+
+	w, _ := p.ReadModel().Get(ctx, "alice:2024-10")
+	if w == nil || w.Hours != 5 {
+		t.Errorf("Weekly hours are not correct: %+v", w)
+	}
+
+	p.Pause()
+	time.Sleep(20 * time.Millisecond)
+	appendLog(store, "4", "alice", 4, monday)
+	time.Sleep(20 * time.Millisecond)
+
+	if lag, _ := p.Lag(ctx); lag != 1 {
+		t.Errorf("Paused projection should lag by 1: %d", lag)
+	}
+
+	p.Resume()
+	waitFor(t, "projection to resume", func() bool {
+		lag, _ := p.Lag(ctx)
+		return lag == 0
+	})
+
+	w.Hours = 100
+	p.ReadModel().Save(ctx, w)
+
+	if err := p.Rebuild(ctx); err != nil {
+		t.Fatalf("Error rebuilding projection: %v", err)
+	}
+
+	w, _ = p.ReadModel().Get(ctx, "alice:2024-10")
+	if w == nil || w.Hours != 9 {
+		t.Errorf("Rebuilt weekly hours are not correct: %+v", w)
+	}
+
+	saved, _ := checkpoints.Load(ctx, "projection:weeklyHours")
+	if saved != "4" {
+		t.Errorf("Projection position was not saved: %s", saved)
+	}
+}
+
+type CleaningLog struct {
+	common.BaseEntity[string]
+	Hours int `json:"hours"`
+}
+
+func TestProjectionStream(t *testing.T) {
+	trans := newChanTransport()
+	logs := common.NewEventService(common.NewInMemoryRepository[*CleaningLog](), trans, "log")
+
+	checkpoints := common.NewInMemoryCheckpointStore()
+	p := weeklyHoursProjection(nil, checkpoints)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- p.RunStream(ctx, trans) }()
+
+	user := context.WithValue(context.Background(), "user", 7)
+	logs.Create(user, &CleaningLog{BaseEntity: common.BaseEntity[string]{ID: "1"}, Hours: 2})
+	logs.Save(user, &CleaningLog{BaseEntity: common.BaseEntity[string]{ID: "1"}, Hours: 3})
+
+	year, week := time.Now().ISOWeek()
+	id := fmt.Sprintf("7:%d-%d", year, week)
+
+	waitFor(t, "projection to apply the service's events", func() bool {
+		w, _ := p.ReadModel().Get(context.Background(), id)
+		return w != nil && w.Hours == 5
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Error running projection: %v", err)
+	}
+
+	if saved, _ := checkpoints.Load(context.Background(), "projection:weeklyHours:stream"); saved == "" {
+		t.Errorf("Projection did not checkpoint the stream")
+	}
+
+	if err := p.Run(context.Background()); !errors.Is(err, common.ErrNoEventLog) {
+		t.Errorf("Run needs an event log: %v", err)
+	}
+}
+
+func TestProjectionStreamStopsOnFailure(t *testing.T) {
+	trans := newChanTransport()
+	p := common.NewProjection("failing", nil, common.NewInMemoryRepository[*WeeklyHours](), common.NewInMemoryCheckpointStore())
+	p.Subscribe("*", func(ctx context.Context, event common.Event) error {
+		return errors.New("read model unavailable")
+	})
+
+	trans.PostEvent(common.Event{EventId: "1", EventType: "logCreated"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := p.RunStream(ctx, trans); err == nil || ctx.Err() != nil {
+		t.Errorf("RunStream should stop with the handler's error: %v", err)
+	}
+}
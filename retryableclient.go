@@ -54,11 +54,22 @@ func (t *retryableTransport) RoundTrip(req *http.Request) (*http.Response, error
 	retries := 0
 	for shouldRetry(err, resp) && retries < t.retries {
 
-		slog.Info("Retrying request", "retries", retries, "maxRetries", t.retries, "error", err, "statusCode", resp.StatusCode, "url", req.URL)
-		// Wait for the specified backoff period
-		time.Sleep(backoff(retries))
+		// resp is nil when the request failed without a response, such as
+		// a refused connection.
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		slog.Info("Retrying request", "retries", retries, "maxRetries", t.retries, "error", err, "statusCode", statusCode, "url", req.URL)
 		// We're going to retry, consume any response to reuse the connection.
 		drainBody(resp)
+		// Wait for the specified backoff period, unless the request is
+		// cancelled first.
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff(retries)):
+		}
 		// Clone the request body again
 		if req.Body != nil {
 			req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
@@ -0,0 +1,364 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "running"
+	SagaCompleted    SagaStatus = "completed"
+	SagaCompensating SagaStatus = "compensating"
+	SagaCompensated  SagaStatus = "compensated"
+)
+
+// ErrSagaTimeout is the reason a saga fails when it passes its deadline and
+// has no timeout handler.
+var ErrSagaTimeout = errors.New("saga timed out")
+
+// SagaState is the persisted state of one saga, keyed by the correlation id
+// of the events that drive it. States are kept in the default tenant and
+// remember the tenant the saga runs for.
+type SagaState[D any] struct {
+	BaseEntity[string]
+	Saga     string     `json:"saga"`
+	TenantId string     `json:"tenantId,omitempty"`
+	Status   SagaStatus `json:"status"`
+	Data     D          `json:"data"`
+	// Steps are the completed steps, compensated in reverse order.
+	Steps    []string  `json:"steps,omitempty"`
+	Deadline time.Time `json:"deadline"`
+	Error    string    `json:"error,omitempty"`
+	// Handled holds the ids of the events the saga has handled, so
+	// redelivered events are skipped.
+	Handled []string `json:"handled,omitempty"`
+	// Pending holds events issued by the saga that are not published yet.
+	Pending []Event `json:"pending,omitempty"`
+}
+
+// SagaContext gives a saga handler its state and lets it issue events. The
+// events are published once the state has been saved.
+type SagaContext[D any] struct {
+	State *SagaState[D]
+	cause Event
+}
+
+// Publish issues an event correlated with the saga and caused by the event
+// being handled.
+func (sc *SagaContext[D]) Publish(eventType string, payload any) error {
+	data, err := JSONCodec{}.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	sc.State.Pending = append(sc.State.Pending, Event{
+		EventId:       NewEventId(),
+		EventType:     eventType,
+		EventData:     string(data),
+		EventVersion:  Version,
+		EventTime:     time.Now(),
+		TenantId:      sc.State.TenantId,
+		AggregateId:   sc.State.ID,
+		AggregateType: sc.State.Saga,
+		CorrelationId: sc.State.ID,
+		CausationId:   sc.cause.EventId,
+	})
+	return nil
+}
+
+// Step records that step has completed, so it is compensated if the saga
+// fails later.
+func (sc *SagaContext[D]) Step(step string) {
+	sc.State.Steps = append(sc.State.Steps, step)
+}
+
+func (sc *SagaContext[D]) Complete() {
+	sc.State.Status = SagaCompleted
+}
+
+// Fail stops the saga and compensates its completed steps.
+func (sc *SagaContext[D]) Fail(reason error) {
+	sc.State.Status = SagaCompensating
+	sc.State.Error = reason.Error()
+}
+
+// SetTimeout sets the saga's deadline to d from now.
+func (sc *SagaContext[D]) SetTimeout(d time.Duration) {
+	sc.State.Deadline = time.Now().Add(d)
+}
+
+// SagaHandler handles an event for a saga. Returning an error leaves the
+// state as it was, so the event can be retried; use Fail to give up.
+type SagaHandler[D any] func(ctx context.Context, sc *SagaContext[D], event Event) error
+
+// Saga coordinates a workflow across events. A saga is started by one of its
+// StartOn event types and then handles its On event types with the same
+// correlation id until it completes or fails.
+type Saga[D any] struct {
+	name          string
+	repo          Repository[*SagaState[D], string]
+	transport     Transport
+	starters      map[string]SagaHandler[D]
+	handlers      map[string]SagaHandler[D]
+	compensations map[string]func(ctx context.Context, sc *SagaContext[D]) error
+	timeout       time.Duration
+	onTimeout     func(ctx context.Context, sc *SagaContext[D]) error
+
+	mu sync.Mutex
+}
+
+// StartOn starts a saga for each event of eventType, keyed by the event's
+// correlation id.
+func (s *Saga[D]) StartOn(eventType string, handler SagaHandler[D]) {
+	s.starters[eventType] = handler
+}
+
+// On handles events of eventType for sagas that are running.
+func (s *Saga[D]) On(eventType string, handler SagaHandler[D]) {
+	s.handlers[eventType] = handler
+}
+
+// Compensate sets how to undo step when the saga fails.
+func (s *Saga[D]) Compensate(step string, compensation func(ctx context.Context, sc *SagaContext[D]) error) {
+	s.compensations[step] = compensation
+}
+
+// SetTimeout sets the deadline of new sagas to d after they start.
+func (s *Saga[D]) SetTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+// OnTimeout sets the handler for sagas that pass their deadline. Without one
+// they fail with ErrSagaTimeout.
+func (s *Saga[D]) OnTimeout(handler func(ctx context.Context, sc *SagaContext[D]) error) {
+	s.onTimeout = handler
+}
+
+// Register subscribes the saga's handlers to sub.
+func (s *Saga[D]) Register(sub EventSubscriber) {
+	for eventType := range s.starters {
+		sub.Subscribe(eventType, s.handle)
+	}
+	for eventType := range s.handlers {
+		if _, ok := s.starters[eventType]; !ok {
+			sub.Subscribe(eventType, s.handle)
+		}
+	}
+}
+
+// Get returns the saga with correlation id, or nil.
+func (s *Saga[D]) Get(ctx context.Context, id string) (*SagaState[D], error) {
+	return s.repo.Get(s.storeContext(ctx), id)
+}
+
+func (s *Saga[D]) handle(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := event.CorrelationId
+	if id == "" {
+		id = event.EventId
+	}
+
+	state, err := s.repo.Get(s.storeContext(ctx), id)
+	if err != nil {
+		return err
+	}
+
+	isNew := state == nil
+	handler := s.handlers[event.EventType]
+	if !isNew {
+		// Work on a copy, so a failed handler leaves the stored state alone
+		// in repositories that hand out their own pointers.
+		if state, err = copyState(state); err != nil {
+			return err
+		}
+	} else {
+		handler = s.starters[event.EventType]
+		if handler == nil {
+			return nil
+		}
+
+		now := time.Now()
+		state = &SagaState[D]{
+			BaseEntity: BaseEntity[string]{ID: id, CreationDate: now, LastUpdateDate: now, Version: 1},
+			Saga:       s.name,
+			TenantId:   event.TenantId,
+			Status:     SagaRunning,
+		}
+		if s.timeout > 0 {
+			state.Deadline = now.Add(s.timeout)
+		}
+	}
+
+	if slices.Contains(state.Handled, event.EventId) {
+		return s.publishPending(ctx, state)
+	}
+	if handler == nil || state.Status != SagaRunning {
+		return nil
+	}
+
+	sc := &SagaContext[D]{State: state, cause: event}
+	if err := handler(ctx, sc, event); err != nil {
+		return err
+	}
+
+	if event.EventId != "" {
+		state.Handled = append(state.Handled, event.EventId)
+	}
+	return s.commit(ctx, sc, isNew)
+}
+
+// CheckTimeouts times out running sagas that are past their deadline and
+// carries on compensating sagas whose compensation failed before.
+func (s *Saga[D]) CheckTimeouts(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states, err := s.repo.GetAll(s.storeContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, state := range states {
+		state, err := copyState(state)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sc := &SagaContext[D]{State: state}
+		sagaCtx := WithTenant(ctx, state.TenantId)
+
+		switch {
+		case state.Status == SagaCompensating:
+		case state.Status == SagaRunning && !state.Deadline.IsZero() && time.Now().After(state.Deadline):
+			slog.Info("Saga timed out", "saga", s.name, "id", state.ID)
+			if s.onTimeout == nil {
+				sc.Fail(ErrSagaTimeout)
+			} else if err := s.onTimeout(sagaCtx, sc); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		default:
+			continue
+		}
+
+		errs = append(errs, s.commit(sagaCtx, sc, false))
+	}
+	return errors.Join(errs...)
+}
+
+// Run checks for timeouts every interval until ctx is done.
+func (s *Saga[D]) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.CheckTimeouts(ctx); err != nil {
+				slog.Error("Error checking saga timeouts", "saga", s.name, "error", err)
+			}
+		}
+	}
+}
+
+// commit compensates a failed saga, saves its state and publishes the events
+// it issued.
+func (s *Saga[D]) commit(ctx context.Context, sc *SagaContext[D], isNew bool) error {
+	state := sc.State
+
+	var compensateErr error
+	if state.Status == SagaCompensating {
+		compensateErr = s.compensate(ctx, sc)
+	}
+
+	state.LastUpdateDate = time.Now()
+
+	var err error
+	if isNew {
+		err = s.repo.Create(s.storeContext(ctx), state)
+	} else {
+		err = s.repo.Save(s.storeContext(ctx), state)
+	}
+	if err != nil {
+		return fmt.Errorf("saving saga %s %s: %w", s.name, state.ID, err)
+	}
+
+	return errors.Join(compensateErr, s.publishPending(ctx, state))
+}
+
+// compensate undoes the completed steps, latest first. It stops at the first
+// compensation that fails, leaving the saga compensating.
+func (s *Saga[D]) compensate(ctx context.Context, sc *SagaContext[D]) error {
+	state := sc.State
+	for len(state.Steps) > 0 {
+		step := state.Steps[len(state.Steps)-1]
+		if compensation, ok := s.compensations[step]; ok {
+			if err := compensation(ctx, sc); err != nil {
+				return fmt.Errorf("compensating step %s of saga %s %s: %w", step, s.name, state.ID, err)
+			}
+		}
+		state.Steps = state.Steps[:len(state.Steps)-1]
+	}
+
+	state.Status = SagaCompensated
+	return nil
+}
+
+func (s *Saga[D]) publishPending(ctx context.Context, state *SagaState[D]) error {
+	if len(state.Pending) == 0 {
+		return nil
+	}
+
+	for len(state.Pending) > 0 {
+		if err := s.transport.PostEvent(state.Pending[0]); err != nil {
+			return errors.Join(err, s.repo.Save(s.storeContext(ctx), state))
+		}
+		state.Pending = state.Pending[1:]
+	}
+	return s.repo.Save(s.storeContext(ctx), state)
+}
+
+// copyState deep copies state through the codec, so maps, slices and
+// pointers in its data are not shared with the stored state.
+func copyState[D any](state *SagaState[D]) (*SagaState[D], error) {
+	data, err := JSONCodec{}.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("copying saga state %s: %w", state.ID, err)
+	}
+
+	var copied SagaState[D]
+	if err := (JSONCodec{}).Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("copying saga state %s: %w", state.ID, err)
+	}
+	return &copied, nil
+}
+
+func (s *Saga[D]) storeContext(ctx context.Context) context.Context {
+	return WithTenant(ctx, "")
+}
+
+// NewSaga returns a saga called name that keeps its state in repo and
+// publishes the events it issues through transport. States are keyed by
+// correlation id alone, so each saga needs a repository of its own.
+func NewSaga[D any](name string, repo Repository[*SagaState[D], string], transport Transport) *Saga[D] {
+	return &Saga[D]{
+		name:          name,
+		repo:          repo,
+		transport:     transport,
+		starters:      make(map[string]SagaHandler[D]),
+		handlers:      make(map[string]SagaHandler[D]),
+		compensations: make(map[string]func(ctx context.Context, sc *SagaContext[D]) error),
+	}
+}
@@ -0,0 +1,135 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type CompletionFlow struct {
+	TaskId string `json:"taskId"`
+	LogId  string `json:"logId"`
+}
+
+func completionSaga(trans common.Transport) *common.Saga[CompletionFlow] {
+	saga := common.NewSaga("completion", common.NewInMemoryRepository[*common.SagaState[CompletionFlow]](), trans)
+
+	saga.StartOn("taskCompleted", func(ctx context.Context, sc *common.SagaContext[CompletionFlow], event common.Event) error {
+		sc.State.Data.TaskId = event.AggregateId
+		return sc.Publish("logRequested", sc.State.Data)
+	})
+	saga.On("logCreated", func(ctx context.Context, sc *common.SagaContext[CompletionFlow], event common.Event) error {
+		sc.State.Data.LogId = event.AggregateId
+		sc.Step("createLog")
+		return sc.Publish("statsRequested", sc.State.Data)
+	})
+	saga.On("statsUpdated", func(ctx context.Context, sc *common.SagaContext[CompletionFlow], event common.Event) error {
+		sc.Complete()
+		return nil
+	})
+	saga.On("statsFailed", func(ctx context.Context, sc *common.SagaContext[CompletionFlow], event common.Event) error {
+		sc.Fail(errors.New("stats update failed"))
+		return nil
+	})
+	saga.Compensate("createLog", func(ctx context.Context, sc *common.SagaContext[CompletionFlow]) error {
+		return sc.Publish("logDeleteRequested", sc.State.Data)
+	})
+	return saga
+}
+
+func TestSagaCompensation(t *testing.T) {
+	trans := &tenantTransport{}
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+
+	saga := completionSaga(trans)
+	saga.Register(es)
+
+	ctx := context.Background()
+	started := common.Event{EventId: "e1", EventType: "taskCompleted", AggregateId: "t1", CorrelationId: "c1", TenantId: "acme"}
+
+	es.HandleEvent(ctx, started)
+	es.HandleEvent(ctx, started)
+
+	if len(trans.events) != 1 || trans.events[0].EventType != "logRequested" || trans.events[0].CorrelationId != "c1" || trans.events[0].TenantId != "acme" {
+		t.Fatalf("Saga did not issue one correlated event: %+v", trans.events)
+	}
+
+	es.HandleEvent(ctx, common.Event{EventId: "e2", EventType: "logCreated", AggregateId: "l1", CorrelationId: "c1"})
+	es.HandleEvent(ctx, common.Event{EventId: "e3", EventType: "statsFailed", CorrelationId: "c1"})
+
+	state, _ := saga.Get(ctx, "c1")
+	if state.Status != common.SagaCompensated || state.Data.LogId != "l1" {
+		t.Errorf("Saga was not compensated: %+v", state)
+	}
+
+	last := trans.events[len(trans.events)-1]
+	if last.EventType != "logDeleteRequested" || last.CausationId != "e3" {
+		t.Errorf("Compensation event is not correct: %+v", last)
+	}
+
+	es.HandleEvent(ctx, common.Event{EventId: "e4", EventType: "statsUpdated", CorrelationId: "c1"})
+	state, _ = saga.Get(ctx, "c1")
+	if state.Status != common.SagaCompensated {
+		t.Errorf("Finished saga should ignore later events: %s", state.Status)
+	}
+}
+
+func TestSagaTimeout(t *testing.T) {
+	trans := &tenantTransport{}
+	saga := completionSaga(trans)
+	saga.SetTimeout(time.Millisecond)
+
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	saga.Register(es)
+
+	ctx := context.Background()
+	es.HandleEvent(ctx, common.Event{EventId: "e1", EventType: "taskCompleted", CorrelationId: "c1"})
+	es.HandleEvent(ctx, common.Event{EventId: "e2", EventType: "logCreated", CorrelationId: "c1"})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if err := saga.CheckTimeouts(ctx); err != nil {
+		t.Fatalf("Error checking timeouts: %v", err)
+	}
+
+	state, _ := saga.Get(ctx, "c1")
+	if state.Status != common.SagaCompensated || state.Error != common.ErrSagaTimeout.Error() {
+		t.Errorf("Saga did not time out: %+v", state)
+	}
+}
+
+type TaggedFlow struct {
+	Tags map[string]string `json:"tags"`
+	Ids  []string          `json:"ids"`
+}
+
+func TestSagaFailedHandlerLeavesStateAlone(t *testing.T) {
+	trans := &tenantTransport{}
+	saga := common.NewSaga("tagged", common.NewInMemoryRepository[*common.SagaState[TaggedFlow]](), trans)
+
+	saga.StartOn("started", func(ctx context.Context, sc *common.SagaContext[TaggedFlow], event common.Event) error {
+		sc.State.Data.Tags = map[string]string{"stage": "started"}
+		sc.State.Data.Ids = []string{"a"}
+		return nil
+	})
+	saga.On("changed", func(ctx context.Context, sc *common.SagaContext[TaggedFlow], event common.Event) error {
+		sc.State.Data.Tags["stage"] = "changed"
+		sc.State.Data.Ids[0] = "b"
+		return errors.New("handler failed")
+	})
+
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), trans, "test")
+	saga.Register(es)
+
+	ctx := context.Background()
+	es.HandleEvent(ctx, common.Event{EventId: "e1", EventType: "started", CorrelationId: "c1"})
+	es.HandleEvent(ctx, common.Event{EventId: "e2", EventType: "changed", CorrelationId: "c1"})
+
+	state, _ := saga.Get(ctx, "c1")
+	if state.Data.Tags["stage"] != "started" || state.Data.Ids[0] != "a" {
+		t.Errorf("Failed handler changed the stored state: %+v", state.Data)
+	}
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const defaultSchedulerPollInterval = time.Minute
+
+var ErrScheduleNotFound = errors.New("scheduled event not found")
+
+// Clock tells the scheduler the time, so tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the real clock.
+var SystemClock Clock = systemClock{}
+
+// ScheduledEvent is an event waiting to be published at DeliverAt. Events
+// with a Cron schedule are published every time it matches until cancelled.
+type ScheduledEvent struct {
+	BaseEntity[string]
+	Event           Event     `json:"event"`
+	DeliverAt       time.Time `json:"deliverAt"`
+	Cron            string    `json:"cron,omitempty"`
+	Deliveries      int       `json:"deliveries"`
+	LastDeliveredAt time.Time `json:"lastDeliveredAt"`
+}
+
+// Scheduler publishes events through a transport at a later time. Scheduled
+// events are kept in a repository, in the default tenant, so they survive
+// restarts; the event itself carries its tenant.
+type Scheduler struct {
+	repo         Repository[*ScheduledEvent, string]
+	transport    Transport
+	clock        Clock
+	pollInterval time.Duration
+	scheduled    chan struct{}
+}
+
+func (s *Scheduler) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// SetPollInterval sets the longest Run waits before checking for due events
+// again, which matters when other processes schedule events in the same
+// repository.
+func (s *Scheduler) SetPollInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSchedulerPollInterval
+	}
+	s.pollInterval = interval
+}
+
+// Schedule publishes event at deliverAt and returns the id to cancel it
+// with.
+func (s *Scheduler) Schedule(ctx context.Context, event Event, deliverAt time.Time) (string, error) {
+	return s.add(ctx, event, deliverAt, "")
+}
+
+// ScheduleCron publishes event every time the cron schedule spec matches.
+func (s *Scheduler) ScheduleCron(ctx context.Context, event Event, spec string) (string, error) {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return "", err
+	}
+
+	next := cron.Next(s.clock.Now())
+	if next.IsZero() {
+		return "", fmt.Errorf("cron %q never matches", spec)
+	}
+	return s.add(ctx, event, next, spec)
+}
+
+// Cancel removes a scheduled event.
+func (s *Scheduler) Cancel(ctx context.Context, id string) error {
+	ctx = s.context(ctx)
+
+	scheduled, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if scheduled == nil {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	return s.repo.Delete(ctx, scheduled)
+}
+
+// Scheduled returns the scheduled events, soonest first.
+func (s *Scheduler) Scheduled(ctx context.Context) ([]*ScheduledEvent, error) {
+	all, err := s.repo.GetAll(s.context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].DeliverAt.Before(all[j].DeliverAt)
+	})
+	return all, nil
+}
+
+// Tick publishes the events that are due and returns how many it published.
+// One-off events are removed once published and recurring ones move on to
+// their next time. An event that fails to publish stays due and is tried
+// again on the next tick.
+func (s *Scheduler) Tick(ctx context.Context) (int, error) {
+	ctx = s.context(ctx)
+
+	all, err := s.Scheduled(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := s.clock.Now()
+	published := 0
+
+	var errs []error
+	for _, scheduled := range all {
+		if scheduled.DeliverAt.After(now) {
+			break
+		}
+
+		if err := s.deliver(ctx, scheduled, now); err != nil {
+			errs = append(errs, fmt.Errorf("delivering scheduled event %s: %w", scheduled.ID, err))
+			continue
+		}
+		published++
+	}
+	return published, errors.Join(errs...)
+}
+
+// Run publishes events as they become due until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		if _, err := s.Tick(ctx); err != nil {
+			slog.Error("Scheduler error", "error", err)
+		}
+
+		wait := s.pollInterval
+		if all, err := s.Scheduled(ctx); err == nil && len(all) > 0 {
+			wait = min(wait, max(all[0].DeliverAt.Sub(s.clock.Now()), 0))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.scheduled:
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+func (s *Scheduler) deliver(ctx context.Context, scheduled *ScheduledEvent, now time.Time) error {
+	event := scheduled.Event
+	event.EventId = NewEventId()
+	event.EventTime = now
+	if event.CorrelationId == "" {
+		event.CorrelationId = scheduled.ID
+	}
+
+	if err := s.transport.PostEvent(event); err != nil {
+		return err
+	}
+
+	if scheduled.Cron == "" {
+		return s.repo.Delete(ctx, scheduled)
+	}
+
+	cron, err := ParseCron(scheduled.Cron)
+	if err != nil {
+		return err
+	}
+
+	scheduled.Deliveries++
+	scheduled.LastDeliveredAt = now
+	scheduled.LastUpdateDate = now
+	scheduled.DeliverAt = cron.Next(now)
+	if scheduled.DeliverAt.IsZero() {
+		return s.repo.Delete(ctx, scheduled)
+	}
+	return s.repo.Save(ctx, scheduled)
+}
+
+func (s *Scheduler) add(ctx context.Context, event Event, deliverAt time.Time, cron string) (string, error) {
+	if event.TenantId == "" {
+		event.TenantId = TenantFromContext(ctx)
+	}
+
+	id := NewEventId()
+	now := s.clock.Now()
+
+	err := s.repo.Create(s.context(ctx), &ScheduledEvent{
+		BaseEntity: BaseEntity[string]{ID: id, CreationDate: now, LastUpdateDate: now, Version: 1},
+		Event:      event,
+		DeliverAt:  deliverAt,
+		Cron:       cron,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case s.scheduled <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+func (s *Scheduler) context(ctx context.Context) context.Context {
+	return WithTenant(ctx, "")
+}
+
+// NewScheduler returns a scheduler that keeps scheduled events in repo and
+// publishes them through transport.
+func NewScheduler(repo Repository[*ScheduledEvent, string], transport Transport) *Scheduler {
+	return &Scheduler{
+		repo:         repo,
+		transport:    transport,
+		clock:        SystemClock,
+		pollInterval: defaultSchedulerPollInterval,
+		scheduled:    make(chan struct{}, 1),
+	}
+}
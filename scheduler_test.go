@@ -0,0 +1,78 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestScheduler(t *testing.T) {
+	dir := t.TempDir()
+	trans := &tenantTransport{}
+	clock := &fakeClock{now: time.Date(2024, 3, 4, 9, 7, 0, 0, time.UTC)}
+
+	scheduler := common.NewScheduler(common.NewFileRepository[*common.ScheduledEvent](dir, "schedule"), trans)
+	scheduler.SetClock(clock)
+
+	ctx := common.WithTenant(context.Background(), "acme")
+
+	overdue, err := scheduler.Schedule(ctx, common.Event{EventType: "cleaningOverdue"}, clock.now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Error scheduling event: %v", err)
+	}
+	cancelled, _ := scheduler.Schedule(ctx, common.Event{EventType: "cleaningOverdue"}, clock.now.Add(time.Hour))
+	scheduler.ScheduleCron(ctx, common.Event{EventType: "cleaningReminder"}, "*/15 * * * *")
+
+	if err := scheduler.Cancel(ctx, cancelled); err != nil {
+		t.Fatalf("Error cancelling event: %v", err)
+	}
+	if err := scheduler.Cancel(ctx, cancelled); !errors.Is(err, common.ErrScheduleNotFound) {
+		t.Errorf("Cancelling twice should not find the event: %v", err)
+	}
+
+	// A new scheduler on the same files picks up where the old one left off.
+	scheduler = common.NewScheduler(common.NewFileRepository[*common.ScheduledEvent](dir, "schedule"), trans)
+	scheduler.SetClock(clock)
+
+	if n, _ := scheduler.Tick(ctx); n != 0 {
+		t.Errorf("Nothing should be due yet: %d", n)
+	}
+
+	clock.advance(8 * time.Minute)
+	if n, _ := scheduler.Tick(ctx); n != 1 || trans.events[0].EventType != "cleaningReminder" || trans.events[0].TenantId != "acme" {
+		t.Fatalf("Cron event was not published: %d %+v", n, trans.events)
+	}
+
+	clock.advance(time.Hour)
+	if n, _ := scheduler.Tick(ctx); n != 2 {
+		t.Errorf("Overdue and reminder events should be published: %d", n)
+	}
+
+	all, _ := scheduler.Scheduled(ctx)
+	if len(all) != 1 || all[0].Cron == "" || all[0].ID == overdue {
+		t.Fatalf("Only the recurring event should remain: %+v", all)
+	}
+
+	if want := time.Date(2024, 3, 4, 10, 30, 0, 0, time.UTC); !all[0].DeliverAt.Equal(want) || all[0].Deliveries != 2 {
+		t.Errorf("Recurring event was not rescheduled: %v %d", all[0].DeliverAt, all[0].Deliveries)
+	}
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Upcaster transforms a payload stored at one schema version into the shape
+// of the next version.
+type Upcaster func(codec Codec, data []byte) ([]byte, error)
+
+type entitySchema struct {
+	current   int
+	upcasters map[int]Upcaster
+}
+
+// SchemaRegistry keeps the current schema version of each entity type and the
+// upcasters that bring older payloads up to date. Entity types are named by
+// the prefix used by the repository or event service.
+type SchemaRegistry struct {
+	schemas map[string]*entitySchema
+	mu      sync.RWMutex
+}
+
+func (sr *SchemaRegistry) Register(entityType string, current int) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.schema(entityType).current = current
+}
+
+func (sr *SchemaRegistry) AddUpcaster(entityType string, fromVersion int, upcaster Upcaster) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.schema(entityType).upcasters[fromVersion] = upcaster
+}
+
+func (sr *SchemaRegistry) CurrentVersion(entityType string) int {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	s, ok := sr.schemas[entityType]
+	if !ok {
+		return 1
+	}
+	return s.current
+}
+
+// Upcast runs the upcasters registered for entityType in order, starting at
+// version, until data is at the current version. Payloads without a version
+// are treated as version 1.
+func (sr *SchemaRegistry) Upcast(entityType string, version int, codec Codec, data []byte) ([]byte, error) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	if version < 1 {
+		version = 1
+	}
+
+	s, ok := sr.schemas[entityType]
+	if !ok {
+		return data, nil
+	}
+
+	if version > s.current {
+		return nil, fmt.Errorf("%s schema version %d is newer than current version %d", entityType, version, s.current)
+	}
+
+	for v := version; v < s.current; v++ {
+		upcaster, ok := s.upcasters[v]
+		if !ok {
+			return nil, fmt.Errorf("no upcaster for %s schema version %d", entityType, v)
+		}
+		var err error
+		data, err = upcaster(codec, data)
+		if err != nil {
+			return nil, fmt.Errorf("upcasting %s from schema version %d: %w", entityType, v, err)
+		}
+	}
+	return data, nil
+}
+
+func (sr *SchemaRegistry) schema(entityType string) *entitySchema {
+	s, ok := sr.schemas[entityType]
+	if !ok {
+		s = &entitySchema{current: 1, upcasters: make(map[int]Upcaster)}
+		sr.schemas[entityType] = s
+	}
+	return s
+}
+
+// RegisterUpcaster adds a typed upcaster that decodes the payload as From and
+// encodes the result as To, so old struct shapes can be kept around to read
+// data written by previous releases.
+func RegisterUpcaster[From, To any](sr *SchemaRegistry, entityType string, fromVersion int, fn func(From) (To, error)) {
+	sr.AddUpcaster(entityType, fromVersion, func(codec Codec, data []byte) ([]byte, error) {
+		var from From
+		if err := codec.Unmarshal(data, &from); err != nil {
+			return nil, err
+		}
+		to, err := fn(from)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Marshal(to)
+	})
+}
+
+// Migrate rewrites every entity in repo. Repositories upcast on read and
+// write the current schema version, so after Migrate all stored data is at
+// the current version.
+func Migrate[T Entity[S], S comparable](ctx context.Context, repo Repository[T, S]) (int, error) {
+	entities, err := repo.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range entities {
+		if err := repo.Save(ctx, e); err != nil {
+			return i, err
+		}
+	}
+	return len(entities), nil
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas: make(map[string]*entitySchema),
+	}
+}
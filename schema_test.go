@@ -0,0 +1,138 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type FlaggedMemcacheClient struct {
+	store map[string]*memcache.Item
+}
+
+func (m *FlaggedMemcacheClient) Set(item *memcache.Item) error {
+	m.store[item.Key] = item
+	return nil
+}
+
+func (m *FlaggedMemcacheClient) Get(key string) (*memcache.Item, error) {
+	if item, ok := m.store[key]; ok {
+		return item, nil
+	}
+	return nil, nil
+}
+
+func (m *FlaggedMemcacheClient) Delete(key string) error {
+	delete(m.store, key)
+	return nil
+}
+
+type NoteV1 struct {
+	common.BaseEntity[string]
+	Note string
+}
+
+type NoteV2 struct {
+	common.BaseEntity[string]
+	Notes []string `json:"notes"`
+}
+
+func noteSchemas() *common.SchemaRegistry {
+	schemas := common.NewSchemaRegistry()
+	schemas.Register("note", 2)
+	common.RegisterUpcaster(schemas, "note", 1, func(old NoteV1) (NoteV2, error) {
+		return NoteV2{BaseEntity: old.BaseEntity, Notes: []string{old.Note}}, nil
+	})
+	return schemas
+}
+
+func TestSchemaRegistryUpcast(t *testing.T) {
+	schemas := noteSchemas()
+
+	data, _ := json.Marshal(NoteV1{BaseEntity: common.BaseEntity[string]{ID: "1"}, Note: "mop floor"})
+
+	data, err := schemas.Upcast("note", 1, common.JSONCodec{}, data)
+	if err != nil {
+		t.Fatalf("Error upcasting: %v", err)
+	}
+
+	var n NoteV2
+	json.Unmarshal(data, &n)
+
+	if len(n.Notes) != 1 || n.Notes[0] != "mop floor" {
+		t.Errorf("Upcast payload is not correct: %s", data)
+	}
+
+	_, err = schemas.Upcast("note", 3, common.JSONCodec{}, data)
+	if err == nil {
+		t.Errorf("Upcasting from a newer version should fail")
+	}
+}
+
+func TestMemcacheRepositoryUpcast(t *testing.T) {
+	mc := &FlaggedMemcacheClient{store: make(map[string]*memcache.Item)}
+
+	old, _ := common.GobCodec{}.Marshal(&NoteV1{BaseEntity: common.BaseEntity[string]{ID: "1"}, Note: "dust shelves"})
+	mc.Set(&memcache.Item{Key: "note1", Value: old, Flags: 1})
+	mc.Set(&memcache.Item{Key: "notekeys", Value: []byte("1,")})
+
+	repo := common.NewMemcacheRepository[*NoteV2]("", "note", mc)
+	repo.(*common.MemcacheRepository[*NoteV2, string]).SetSchemaRegistry(noteSchemas())
+
+	ctx := context.Background()
+
+	n, err := repo.Get(ctx, "1")
+	if err != nil {
+		t.Fatalf("Error getting entity: %v", err)
+	}
+
+	if len(n.Notes) != 1 || n.Notes[0] != "dust shelves" {
+		t.Errorf("Entity was not upcast: %+v", n)
+	}
+
+	count, err := common.Migrate(ctx, repo)
+	if err != nil {
+		t.Fatalf("Error migrating: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("Migrated count is not correct: %d", count)
+	}
+
+	if mc.store["note1"].Flags != 2 {
+		t.Errorf("Entity was not rewritten at current version: %d", mc.store["note1"].Flags)
+	}
+}
+
+func TestEventServiceUpcast(t *testing.T) {
+	repo := common.NewInMemoryRepository[*NoteV2]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "note")
+	es.SetSchemaRegistry(noteSchemas())
+
+	ctx := context.Background()
+
+	es.Create(ctx, &NoteV2{BaseEntity: common.BaseEntity[string]{ID: "2"}})
+	if trans.events[0].SchemaVersion != 2 {
+		t.Errorf("Event schema version is not correct: %d", trans.events[0].SchemaVersion)
+	}
+
+	data, _ := json.Marshal(NoteV1{BaseEntity: common.BaseEntity[string]{ID: "1"}, Note: "wipe windows"})
+
+	err := es.HandleEvent(ctx, common.Event{
+		EventType:     "noteCreated",
+		EventData:     string(data),
+		SchemaVersion: 1,
+	})
+	if err != nil {
+		t.Fatalf("Error handling event: %v", err)
+	}
+
+	n, _ := es.Get(ctx, "1")
+	if n == nil || len(n.Notes) != 1 || n.Notes[0] != "wipe windows" {
+		t.Errorf("Event payload was not upcast: %+v", n)
+	}
+}
@@ -0,0 +1,227 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Snapshot is an aggregate's encoded state at a version. Snapshots taken at a
+// different schema version than the aggregate's current one are ignored.
+type Snapshot struct {
+	AggregateId   string    `json:"aggregateId"`
+	AggregateType string    `json:"aggregateType"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schemaVersion"`
+	Data          []byte    `json:"data"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// SnapshotStore keeps the latest snapshot of each aggregate, partitioned by
+// the tenant in ctx.
+type SnapshotStore interface {
+	Save(ctx context.Context, snapshot Snapshot) error
+	// Latest returns nil if the aggregate has no snapshot.
+	Latest(ctx context.Context, aggregateType, aggregateId string) (*Snapshot, error)
+}
+
+// SnapshotPolicy decides when to snapshot an aggregate: once Every events
+// have been appended since the last snapshot, or once Interval has passed
+// since it. Zero values are ignored.
+type SnapshotPolicy struct {
+	Every    int
+	Interval time.Duration
+}
+
+func (p SnapshotPolicy) due(eventsSince int, since time.Time) bool {
+	if eventsSince <= 0 {
+		return false
+	}
+	if p.Every > 0 && eventsSince >= p.Every {
+		return true
+	}
+	return p.Interval > 0 && time.Since(since) >= p.Interval
+}
+
+type InMemorySnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots map[snapshotKey]Snapshot
+}
+
+type snapshotKey struct {
+	tenantId      string
+	aggregateType string
+	aggregateId   string
+}
+
+func (s *InMemorySnapshotStore) Save(ctx context.Context, snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[snapshotKey{TenantFromContext(ctx), snapshot.AggregateType, snapshot.AggregateId}] = snapshot
+	return nil
+}
+
+func (s *InMemorySnapshotStore) Latest(ctx context.Context, aggregateType, aggregateId string) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot, ok := s.snapshots[snapshotKey{TenantFromContext(ctx), aggregateType, aggregateId}]
+	if !ok {
+		return nil, nil
+	}
+	return &snapshot, nil
+}
+
+func NewInMemorySnapshotStore() *InMemorySnapshotStore {
+	return &InMemorySnapshotStore{
+		snapshots: make(map[snapshotKey]Snapshot),
+	}
+}
+
+// FileSnapshotStore keeps each snapshot as a JSON file under dir, one
+// directory per tenant and aggregate type.
+type FileSnapshotStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (s *FileSnapshotStore) Save(ctx context.Context, snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path(ctx, snapshot.AggregateType, snapshot.AggregateId)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileSnapshotStore) Latest(ctx context.Context, aggregateType, aggregateId string) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path(ctx, aggregateType, aggregateId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (s *FileSnapshotStore) path(ctx context.Context, aggregateType, aggregateId string) string {
+	dir := s.dir
+	if tenantId := TenantFromContext(ctx); tenantId != "" {
+		dir = filepath.Join(dir, "tenant-"+url.PathEscape(tenantId))
+	}
+	return filepath.Join(dir, url.PathEscape(aggregateType), url.PathEscape(aggregateId)+".snap")
+}
+
+func NewFileSnapshotStore(dir string) *FileSnapshotStore {
+	return &FileSnapshotStore{dir: dir}
+}
+
+// SetSnapshots makes the repository snapshot aggregates in store according
+// to policy and start loading from the latest snapshot.
+func (r *EventSourcedRepository[T, S]) SetSnapshots(store SnapshotStore, policy SnapshotPolicy) {
+	r.snapshots = store
+	r.snapshotPolicy = policy
+}
+
+// SetCodec sets the codec snapshots are encoded with. The default is gob.
+func (r *EventSourcedRepository[T, S]) SetCodec(codec Codec) {
+	r.codec = codec
+}
+
+// SetSchemaRegistry sets the registry that gives the aggregate's current
+// schema version. Snapshots at any other version are ignored.
+func (r *EventSourcedRepository[T, S]) SetSchemaRegistry(schemas *SchemaRegistry) {
+	r.schemas = schemas
+}
+
+func (r *EventSourcedRepository[T, S]) schemaVersion() int {
+	if r.schemas == nil {
+		return 0
+	}
+	return r.schemas.CurrentVersion(r.prefix)
+}
+
+// restore decodes the latest usable snapshot of an aggregate into e and
+// returns its version, or 0 if there is none.
+func (r *EventSourcedRepository[T, S]) restore(ctx context.Context, aggregateId string, e T) int {
+	if r.snapshots == nil {
+		return 0
+	}
+
+	snapshot, err := r.snapshots.Latest(ctx, r.prefix, aggregateId)
+	if err != nil {
+		slog.Error("Error loading snapshot", "aggregateId", aggregateId, "error", err)
+		return 0
+	}
+	if snapshot == nil || snapshot.SchemaVersion != r.schemaVersion() {
+		return 0
+	}
+
+	if err := r.codec.Unmarshal(snapshot.Data, &e); err != nil {
+		slog.Error("Error decoding snapshot", "aggregateId", aggregateId, "error", err)
+		return 0
+	}
+	return snapshot.Version
+}
+
+// snapshotIfDue snapshots e if the policy says so. Failures are logged, since
+// the events themselves are safely stored.
+func (r *EventSourcedRepository[T, S]) snapshotIfDue(ctx context.Context, e T) {
+	if r.snapshots == nil {
+		return
+	}
+
+	aggregateId := fmt.Sprint(e.GetID())
+
+	version, since := 0, e.GetCreationDate()
+	last, err := r.snapshots.Latest(ctx, r.prefix, aggregateId)
+	if err == nil && last != nil && last.SchemaVersion == r.schemaVersion() {
+		version, since = last.Version, last.CreatedAt
+	}
+
+	if !r.snapshotPolicy.due(e.GetVersion()-version, since) {
+		return
+	}
+
+	data, err := r.codec.Marshal(e)
+	if err == nil {
+		err = r.snapshots.Save(ctx, Snapshot{
+			AggregateId:   aggregateId,
+			AggregateType: r.prefix,
+			Version:       e.GetVersion(),
+			SchemaVersion: r.schemaVersion(),
+			Data:          data,
+			CreatedAt:     time.Now(),
+		})
+	}
+	if err != nil {
+		slog.Error("Error saving snapshot", "aggregateId", aggregateId, "error", err)
+	}
+}
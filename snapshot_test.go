@@ -0,0 +1,87 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type countingChore struct {
+	Chore
+	replayed *int
+}
+
+func (c *countingChore) When(event common.Event) error {
+	*c.replayed++
+	return c.Chore.When(event)
+}
+
+func TestEventSourcedRepositorySnapshots(t *testing.T) {
+	replayed := 0
+	factory := func() *countingChore { return &countingChore{replayed: &replayed} }
+
+	store := common.NewInMemoryEventStore()
+	snapshots := common.NewInMemorySnapshotStore()
+
+	repo := common.NewEventSourcedRepository[*countingChore](store, "chore", factory)
+	repo.(*common.EventSourcedRepository[*countingChore, string]).SetSnapshots(snapshots, common.SnapshotPolicy{Every: 3})
+
+	ctx := context.Background()
+
+	c := factory()
+	c.Apply(c, "choreOpened", ChoreOpened{ID: "1", Title: "descale kettle"})
+	repo.Create(ctx, c)
+
+	for i := 0; i < 3; i++ {
+		c, _ = repo.Get(ctx, "1")
+		c.Apply(c, "choreDone", struct{}{})
+		repo.Save(ctx, c)
+	}
+
+	snapshot, _ := snapshots.Latest(ctx, "chore", "1")
+	if snapshot == nil || snapshot.Version != 3 {
+		t.Fatalf("Snapshot was not taken at version 3: %+v", snapshot)
+	}
+
+	replayed = 0
+	c, err := repo.Get(ctx, "1")
+	if err != nil {
+		t.Fatalf("Error getting aggregate: %v", err)
+	}
+
+	if replayed != 1 {
+		t.Errorf("Only events after the snapshot should be replayed: %d", replayed)
+	}
+
+	if c.Title != "descale kettle" || !c.Done || c.Version != 4 {
+		t.Errorf("Aggregate was not restored: %+v", c.Chore)
+	}
+
+	schemas := common.NewSchemaRegistry()
+	schemas.Register("chore", 2)
+	repo.(*common.EventSourcedRepository[*countingChore, string]).SetSchemaRegistry(schemas)
+
+	replayed = 0
+	repo.Get(ctx, "1")
+	if replayed != 4 {
+		t.Errorf("Snapshot from an old schema version should be ignored: %d", replayed)
+	}
+}
+
+func TestFileSnapshotStore(t *testing.T) {
+	store := common.NewFileSnapshotStore(t.TempDir())
+	acme := common.WithTenant(context.Background(), "acme")
+
+	store.Save(acme, common.Snapshot{AggregateId: "1", AggregateType: "chore", Version: 7, Data: []byte("state")})
+
+	snapshot, err := store.Latest(acme, "chore", "1")
+	if err != nil || snapshot == nil || snapshot.Version != 7 || string(snapshot.Data) != "state" {
+		t.Errorf("Snapshot was not loaded: %+v %v", snapshot, err)
+	}
+
+	snapshot, _ = store.Latest(context.Background(), "chore", "1")
+	if snapshot != nil {
+		t.Errorf("Snapshot should not be visible to another tenant")
+	}
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// subscription is a handler registered for an event type pattern. Patterns
+// are an exact event type, a prefix such as "Task*", a suffix such as
+// "*Deleted", or "*" for every event.
+type subscription struct {
+	pattern string
+	handler EventHandler
+}
+
+func (s subscription) matches(eventType string) bool {
+	switch {
+	case s.pattern == "*":
+		return true
+	case strings.HasSuffix(s.pattern, "*"):
+		return strings.HasPrefix(eventType, strings.TrimSuffix(s.pattern, "*"))
+	case strings.HasPrefix(s.pattern, "*"):
+		return strings.HasSuffix(eventType, strings.TrimPrefix(s.pattern, "*"))
+	default:
+		return s.pattern == eventType
+	}
+}
+
+// Subscribe adds a handler for every event type matching pattern. Any number
+// of handlers can match an event. They run after the service's own handler
+// from Handlers, in the order they were subscribed.
+func (es *EventServiceImpl[T, S]) Subscribe(pattern string, handler EventHandler) {
+	es.subscriptions = append(es.subscriptions, subscription{pattern: pattern, handler: handler})
+}
+
+// SetFallbackHandler sets the handler for events no other handler matches.
+func (es *EventServiceImpl[T, S]) SetFallbackHandler(handler EventHandler) {
+	es.fallback = handler
+}
+
+func (es *EventServiceImpl[T, S]) matchingHandlers(eventType string) []EventHandler {
+	handlers := []EventHandler{}
+	if h, ok := es.Handlers[eventType]; ok {
+		handlers = append(handlers, h)
+	}
+	for _, s := range es.subscriptions {
+		if s.matches(eventType) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	return handlers
+}
+
+// dispatcher returns a handler that runs every handler matching eventType.
+// All of them run even if one fails, and the errors are joined. It returns
+// the fallback handler when nothing matches, which may be nil.
+//
+// When several handlers match, the ones that succeed are recorded for the
+// rest of the current attempt to handle the event, so a retry, whether by the
+// runner or by middleware, only runs the ones that failed. Nothing is kept
+// once the event is done with, so a later event with the same id runs them
+// all.
+func (es *EventServiceImpl[T, S]) dispatcher(eventType string) EventHandler {
+	handlers := es.matchingHandlers(eventType)
+
+	switch len(handlers) {
+	case 0:
+		return es.fallback
+	case 1:
+		return handlers[0]
+	}
+
+	return func(ctx context.Context, event Event) error {
+		progress := handlerProgressFromContext(ctx)
+
+		var errs []error
+		for i, h := range handlers {
+			key := handlerKey{eventId: event.EventId, eventType: event.EventType, handler: i}
+			if progress.done(key) {
+				continue
+			}
+
+			if err := h(ctx, event); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			progress.mark(key)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// handlerProgress records which of an event's handlers have succeeded while
+// it is being handled and retried. A nil handlerProgress records nothing.
+type handlerProgress struct {
+	mu        sync.Mutex
+	succeeded map[handlerKey]bool
+}
+
+type handlerKey struct {
+	eventId   string
+	eventType string
+	handler   int
+}
+
+func (p *handlerProgress) done(key handlerKey) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.succeeded[key]
+}
+
+func (p *handlerProgress) mark(key handlerKey) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.succeeded[key] = true
+}
+
+// withHandlerProgress starts recording handler progress, unless ctx already
+// records it for an attempt in progress.
+func withHandlerProgress(ctx context.Context) context.Context {
+	if handlerProgressFromContext(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, "handlerProgress", &handlerProgress{succeeded: make(map[handlerKey]bool)})
+}
+
+func handlerProgressFromContext(ctx context.Context) *handlerProgress {
+	progress, _ := ctx.Value("handlerProgress").(*handlerProgress)
+	return progress
+}
@@ -0,0 +1,130 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestSubscriptionPatterns(t *testing.T) {
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), &tenantTransport{}, "task")
+	es.SetHandlers(common.EventHandlers{})
+
+	calls := []string{}
+	record := func(name string) common.EventHandler {
+		return func(ctx context.Context, event common.Event) error {
+			calls = append(calls, name+":"+event.EventType)
+			return nil
+		}
+	}
+
+	es.Subscribe("task*", record("prefix"))
+	es.Subscribe("*Deleted", record("suffix"))
+	es.Subscribe("*", record("all"))
+	es.Subscribe("taskDeleted", record("exact"))
+	es.SetFallbackHandler(record("fallback"))
+
+	ctx := context.Background()
+
+	es.HandleEvent(ctx, common.Event{EventType: "taskDeleted"})
+	es.HandleEvent(ctx, common.Event{EventType: "logDeleted"})
+	es.HandleEvent(ctx, common.Event{EventType: "taskCreated"})
+
+	want := []string{
+		"prefix:taskDeleted", "suffix:taskDeleted", "all:taskDeleted", "exact:taskDeleted",
+		"suffix:logDeleted", "all:logDeleted",
+		"prefix:taskCreated", "all:taskCreated",
+	}
+
+	if len(calls) != len(want) {
+		t.Fatalf("Handler calls are not correct: %v", calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("Handler calls are not correct: %v", calls)
+			break
+		}
+	}
+}
+
+func TestFallbackHandler(t *testing.T) {
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), &tenantTransport{}, "task")
+
+	unknown := ""
+	es.SetFallbackHandler(func(ctx context.Context, event common.Event) error {
+		unknown = event.EventType
+		return nil
+	})
+
+	es.HandleEvent(context.Background(), common.Event{EventType: "userRenamed"})
+
+	if unknown != "userRenamed" {
+		t.Errorf("Fallback handler was not called: %s", unknown)
+	}
+}
+
+func TestSubscriptionRetryOnlyRunsFailedHandlers(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "task")
+	es.Use(common.EventRetry(common.RetryPolicy{MaxAttempts: 2}))
+
+	calls := 0
+	es.Subscribe("taskCreated", func(ctx context.Context, event common.Event) error {
+		calls++
+		if calls == 1 {
+			return errors.New("subscriber failed")
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	es.Create(ctx, &common.BaseEntity[string]{ID: "1"})
+
+	// The retry runs the subscriber again but not the service's own handler,
+	// which would fail as the entity already exists.
+	if err := es.HandleEvent(ctx, trans.events[0]); err != nil {
+		t.Fatalf("Error handling event: %v", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("Subscriber was not retried: %d calls", calls)
+	}
+
+	if ok, _ := repo.Exists(ctx, "1"); !ok {
+		t.Errorf("Entity was not created")
+	}
+}
+
+func TestSubscriptionEventsSharingAnId(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[string]]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "task")
+
+	calls := 0
+	es.Subscribe("taskCreated", func(ctx context.Context, event common.Event) error {
+		calls++
+		return nil
+	})
+
+	ctx := context.Background()
+	es.Create(ctx, &common.BaseEntity[string]{ID: "a"})
+	es.Create(ctx, &common.BaseEntity[string]{ID: "b"})
+
+	// Producers that predate unique ids send every event as "1".
+	for _, event := range trans.events {
+		event.EventId = "1"
+		if err := es.HandleEvent(ctx, event); err != nil {
+			t.Fatalf("Error handling event: %v", err)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("Subscriber should run for both events: %d calls", calls)
+	}
+	if ok, _ := repo.Exists(ctx, "b"); !ok {
+		t.Errorf("Second event with the same id was dropped")
+	}
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"context"
+	"strings"
+)
+
+func WithTenant(ctx context.Context, tenantId string) context.Context {
+	return context.WithValue(ctx, "tenant", tenantId)
+}
+
+func TenantFromContext(ctx context.Context) string {
+	tenantId, _ := ctx.Value("tenant").(string)
+	return tenantId
+}
+
+// keyEscaper escapes the tenant separator in the segments of tenant keys.
+var keyEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// tenantKey returns the key prefix used to partition storage by tenant. The
+// default tenant has an empty prefix so data written before tenants existed
+// stays readable.
+func tenantKey(ctx context.Context) string {
+	tenantId := TenantFromContext(ctx)
+	if tenantId == "" {
+		return ""
+	}
+	return keyEscaper.Replace(tenantId) + ":"
+}
+
+// storageKey returns the key for id in the tenant from ctx. Ids in the
+// default tenant are used as they are, so existing keys stay readable. In
+// other tenants only the tenant prefix contains an unescaped ':', so keys of
+// different tenants never collide, though they can still match an id in the
+// default tenant that contains ':'.
+func storageKey(ctx context.Context, id string) string {
+	if TenantFromContext(ctx) == "" {
+		return id
+	}
+	return tenantKey(ctx) + keyEscaper.Replace(id)
+}
@@ -0,0 +1,176 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	common "github.com/papawattu/cleanlog-common"
+)
+
+func TestInMemoryRepoTenants(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[int]]()
+
+	acme := common.WithTenant(context.Background(), "acme")
+	globex := common.WithTenant(context.Background(), "globex")
+
+	err := repo.Create(acme, &common.BaseEntity[int]{ID: 1})
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	ok, _ := repo.Exists(globex, 1)
+	if ok {
+		t.Errorf("Entity should not be visible to another tenant")
+	}
+
+	err = repo.Create(globex, &common.BaseEntity[int]{ID: 1})
+	if err != nil {
+		t.Errorf("Error creating entity with same id for another tenant: %v", err)
+	}
+
+	all, _ := repo.GetAll(acme)
+	if len(all) != 1 {
+		t.Errorf("Tenant should have 1 entity: %d", len(all))
+	}
+
+	all, _ = repo.GetAll(context.Background())
+	if len(all) != 0 {
+		t.Errorf("Default tenant should have no entities: %d", len(all))
+	}
+}
+
+func TestMemcacheRepositoryTenants(t *testing.T) {
+	mc := &FlaggedMemcacheClient{store: make(map[string]*memcache.Item)}
+	mr := common.NewMemcacheRepository[*common.BaseEntity[string]]("localhost:11211", "test", mc)
+
+	acme := common.WithTenant(context.Background(), "acme")
+
+	err := mr.Create(acme, &common.BaseEntity[string]{ID: "1"})
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	if _, ok := mc.store["testacme:1"]; !ok {
+		t.Errorf("Entity key is not partitioned by tenant: %v", mc.store)
+	}
+
+	if _, ok := mc.store["testacme:keys"]; !ok {
+		t.Errorf("Key index is not partitioned by tenant: %v", mc.store)
+	}
+
+	ok, _ := mr.Exists(context.Background(), "1")
+	if ok {
+		t.Errorf("Entity should not be visible to the default tenant")
+	}
+
+	// Ids that look like tenant keys stay in their own tenant.
+	if ok, _ := mr.Exists(context.Background(), "acme:1"); ok {
+		t.Errorf("Default tenant can read another tenant's entity")
+	}
+
+	mr.Delete(context.Background(), &common.BaseEntity[string]{ID: "acme:1"})
+	if ok, _ := mr.Exists(acme, "1"); !ok {
+		t.Errorf("Default tenant deleted another tenant's entity")
+	}
+
+	if err := mr.Create(context.Background(), &common.BaseEntity[string]{ID: "acme:keys"}); err == nil {
+		t.Errorf("Default tenant should not be able to replace a tenant's key index")
+	}
+
+	all, _ := mr.GetAll(acme)
+	if len(all) != 1 || all[0].ID != "1" {
+		t.Errorf("Tenant key index was overwritten: %+v", all)
+	}
+
+	if err := mr.Create(acme, &common.BaseEntity[string]{ID: "keys"}); err == nil {
+		t.Errorf("The key index id should be rejected")
+	}
+}
+
+func TestMemcacheRepositoryDefaultTenantKeys(t *testing.T) {
+	mc := &FlaggedMemcacheClient{store: make(map[string]*memcache.Item)}
+
+	// Written before tenants existed, under the bare id.
+	value, _ := common.GobCodec{}.Marshal(&common.BaseEntity[string]{ID: "chore:1"})
+	mc.Set(&memcache.Item{Key: "testchore:1", Value: value})
+	mc.Set(&memcache.Item{Key: "testkeys", Value: []byte("chore:1,")})
+
+	mr := common.NewMemcacheRepository[*common.BaseEntity[string]]("localhost:11211", "test", mc)
+
+	e, err := mr.Get(context.Background(), "chore:1")
+	if err != nil || e.ID != "chore:1" {
+		t.Fatalf("Existing entity with ':' in its id is not readable: %+v %v", e, err)
+	}
+
+	if all, _ := mr.GetAll(context.Background()); len(all) != 1 {
+		t.Errorf("Existing key index is not readable: %+v", all)
+	}
+
+	if ok, _ := mr.Exists(common.WithTenant(context.Background(), "chore"), "1"); ok {
+		t.Errorf("Tenant can read a default tenant entity with the same key")
+	}
+}
+
+func TestSnapshotStoreTenants(t *testing.T) {
+	store := common.NewInMemorySnapshotStore()
+
+	acme := common.WithTenant(context.Background(), "acme")
+	store.Save(acme, common.Snapshot{AggregateType: "chore", AggregateId: "1"})
+
+	if s, _ := store.Latest(context.Background(), "acme:chore", "1"); s != nil {
+		t.Errorf("Default tenant can read another tenant's snapshot: %+v", s)
+	}
+	if s, _ := store.Latest(acme, "chore", "1"); s == nil {
+		t.Errorf("Snapshot should be visible to its tenant")
+	}
+}
+
+type tenantTransport struct {
+	events []common.Event
+}
+
+func (t *tenantTransport) Connect(context.Context) error {
+	return nil
+}
+
+func (t *tenantTransport) PostEvent(e common.Event) error {
+	t.events = append(t.events, e)
+	return nil
+}
+
+func (t *tenantTransport) NextEvent() (*common.Event, error) {
+	return nil, nil
+}
+
+func TestEventServiceTenants(t *testing.T) {
+	repo := common.NewInMemoryRepository[*common.BaseEntity[int]]()
+	trans := &tenantTransport{}
+	es := common.NewEventService(repo, trans, "test")
+
+	acme := common.WithTenant(context.Background(), "acme")
+
+	err := es.Create(acme, &common.BaseEntity[int]{ID: 1})
+	if err != nil {
+		t.Fatalf("Error creating entity: %v", err)
+	}
+
+	if trans.events[0].TenantId != "acme" {
+		t.Fatalf("Event tenant is not correct: %s", trans.events[0].TenantId)
+	}
+
+	err = es.HandleEvent(context.Background(), trans.events[0])
+	if err != nil {
+		t.Fatalf("Error handling event: %v", err)
+	}
+
+	ok, _ := es.Exists(acme, 1)
+	if !ok {
+		t.Errorf("Entity should exist for its tenant")
+	}
+
+	ok, _ = es.Exists(common.WithTenant(context.Background(), "globex"), 1)
+	if ok {
+		t.Errorf("Entity should not exist for another tenant")
+	}
+}
@@ -0,0 +1,22 @@
+package common
+
+import "context"
+
+type EventSubscriber interface {
+	Subscribe(pattern string, handler EventHandler)
+	EventCodec() Codec
+}
+
+// On subscribes a handler that receives the event payload decoded as P with
+// the subscriber's codec. A payload that does not decode is returned as an
+// *EventDecodeError from the handler. It is not retried, as it would fail the
+// same way, and goes straight to dead letter handling.
+func On[P any](sub EventSubscriber, pattern string, handler func(ctx context.Context, payload P, event Event) error) {
+	sub.Subscribe(pattern, func(ctx context.Context, event Event) error {
+		var payload P
+		if err := sub.EventCodec().Unmarshal([]byte(event.EventData), &payload); err != nil {
+			return &EventDecodeError{Data: event.EventData, Err: err}
+		}
+		return handler(ctx, payload, event)
+	})
+}
@@ -0,0 +1,67 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	common "github.com/papawattu/cleanlog-common"
+)
+
+type TaskCompleted struct {
+	ID    string `json:"id"`
+	Hours int    `json:"hours"`
+}
+
+func TestOnTypedHandler(t *testing.T) {
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), &tenantTransport{}, "log")
+
+	var got TaskCompleted
+	common.On(es, "taskUpdated", func(ctx context.Context, payload TaskCompleted, event common.Event) error {
+		got = payload
+		return nil
+	})
+
+	ctx := context.Background()
+
+	err := es.HandleEvent(ctx, common.Event{EventType: "taskUpdated", EventData: `{"id":"t1","hours":3}`})
+	if err != nil {
+		t.Fatalf("Error handling event: %v", err)
+	}
+
+	if got.ID != "t1" || got.Hours != 3 {
+		t.Errorf("Payload is not correct: %+v", got)
+	}
+
+	err = es.HandleEvent(ctx, common.Event{EventType: "taskUpdated", EventData: `{"hours":"three"}`})
+
+	var decodeErr *common.EventDecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Errorf("Decode failure should be returned as a decode error: %v", err)
+	}
+}
+
+func TestOnDecodeFailureIsNotRetried(t *testing.T) {
+	es := common.NewEventService(common.NewInMemoryRepository[*common.BaseEntity[string]](), &tenantTransport{}, "log")
+
+	calls := 0
+	es.Use(common.EventRetry(common.RetryPolicy{MaxAttempts: 5}))
+	es.UseFor("taskUpdated", func(next common.EventHandler) common.EventHandler {
+		return func(ctx context.Context, event common.Event) error {
+			calls++
+			return next(ctx, event)
+		}
+	})
+
+	common.On(es, "taskUpdated", func(ctx context.Context, payload TaskCompleted, event common.Event) error {
+		return nil
+	})
+
+	err := es.HandleEvent(context.Background(), common.Event{EventType: "taskUpdated", EventData: `{"hours":"three"}`})
+	if err == nil {
+		t.Fatal("Decode failure should be returned")
+	}
+	if calls != 1 {
+		t.Errorf("Decode failure was retried: %d calls", calls)
+	}
+}